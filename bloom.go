@@ -0,0 +1,172 @@
+package kvimd
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// bloomHeaderSize is the size of the header of a bloom filter file. It contains:
+	//   - [0:8] the number of bits of the filter
+	//   - [8:12] the number of hash functions
+	//   - [12:16] whether the filter is clean (1) or dirty (0, it was opened and may have been modified since)
+	bloomHeaderSize = 16
+	// bloomBitsPerKey and bloomHashes give a false positive rate of ~1%
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// bloomFilter is a mmapped Bloom filter of the keys of a HashDisk (db#.bloom), so that looking up a key
+// that is not in the HashDisk rarely needs to probe it.
+// As the mmap can be written back partially on a crash, the filter is marked dirty before the first Add
+// and clean on Close: a filter that is not clean when opened must be rebuilt (see Reset).
+// Add and MayContain are thread-safe (bits are set with atomic operations), Reset and Close are not
+type bloomFilter struct {
+	bits       uint64
+	hashes     uint32
+	dirty      uint32 // In-memory copy of the clean flag (1 once marked dirty), accessed atomically
+	dirtyMutex sync.Mutex
+	file       *os.File
+	m          mmap.MMap
+}
+
+// newBloomFilter opens the bloom filter at path or creates it, sized for keys keys.
+// clean is false if the filter was just created or was not closed properly: it must be rebuilt
+func newBloomFilter(path string, keys uint32) (b *bloomFilter, clean bool, err error) {
+	bits := (uint64(keys)*bloomBitsPerKey + 64 + 31) &^ 31 // Whole uint32 words, for atomic operations
+	size := int64(bloomHeaderSize + bits/8)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to open file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false, errors.Wrap(err, "failed to get file infos")
+	}
+	if info.Size() != size {
+		// New (or not matching the HashDisk anymore), start from an empty one
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, false, errors.Wrap(err, "failed to resize file")
+		}
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, false, errors.Wrap(err, "failed to resize file")
+		}
+	}
+	m, err := mmap.Map(f, mmap.RDWR, 0)
+	if err != nil {
+		f.Close()
+		return nil, false, errors.Wrap(err, "failed to mmap file")
+	}
+
+	clean = encoding.Uint64(m[0:8]) == bits && encoding.Uint32(m[8:12]) == bloomHashes && encoding.Uint32(m[12:16]) == 1
+	return &bloomFilter{
+		bits:   bits,
+		hashes: bloomHashes,
+		file:   f,
+		m:      m,
+	}, clean, nil
+}
+
+// Reset empties the filter. It is marked dirty until Close
+func (b *bloomFilter) Reset() error {
+	if err := b.markDirty(); err != nil {
+		return err
+	}
+	data := b.m[bloomHeaderSize:]
+	for i := range data {
+		data[i] = 0
+	}
+	encoding.PutUint64(b.m[0:8], b.bits)
+	encoding.PutUint32(b.m[8:12], b.hashes)
+	return nil
+}
+
+// Add key to the filter
+func (b *bloomFilter) Add(key []byte) error {
+	if err := b.markDirty(); err != nil {
+		return err
+	}
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < b.hashes; i++ {
+		word, mask := b.bit(uint64(h1) + uint64(i)*uint64(h2))
+		for {
+			old := atomic.LoadUint32(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint32(word, old, old|mask) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// MayContain returns false if key was never added to the filter. If it returns true, key was probably added
+func (b *bloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < b.hashes; i++ {
+		word, mask := b.bit(uint64(h1) + uint64(i)*uint64(h2))
+		if atomic.LoadUint32(word)&mask == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bit returns the word of the filter holding the bit at position hash (modulo the size of the filter) and its mask.
+// Bit n is bit n%8 of byte n/8, whatever the byte order of the machine
+func (b *bloomFilter) bit(hash uint64) (word *uint32, mask uint32) {
+	bit := hash % b.bits
+	var masks [4]byte
+	masks[bit/8%4] = 1 << (bit % 8)
+	return wordAt(b.m, bloomHeaderSize+bit/32*4), nativeEndian.Uint32(masks[:])
+}
+
+// markDirty persists that the filter is being modified, before the first modification
+func (b *bloomFilter) markDirty() error {
+	if atomic.LoadUint32(&b.dirty) == 1 {
+		return nil
+	}
+	b.dirtyMutex.Lock()
+	defer b.dirtyMutex.Unlock()
+	if b.dirty == 1 {
+		return nil
+	}
+	encoding.PutUint32(b.m[12:16], 0)
+	if err := b.m.Flush(); err != nil {
+		return errors.Wrap(err, "failed to flush bloom filter")
+	}
+	atomic.StoreUint32(&b.dirty, 1)
+	return nil
+}
+
+// Close flushes the filter, marks it clean and closes it. It is not safe to call any other method after it
+func (b *bloomFilter) Close() error {
+	var err1 error
+	if b.dirty == 1 {
+		// The content must be on disk before the flag says so
+		if err1 = b.m.Flush(); err1 == nil {
+			encoding.PutUint32(b.m[12:16], 1)
+		}
+	}
+	err2 := b.m.Unmap()
+	err3 := b.file.Close()
+	return firstError(err1, err2, err3)
+}
+
+// bloomHash returns the 2 hashes of key from which all the bit positions are derived (double hashing).
+// It is FNV-1a (64 bits), independent of the hash used to find the slot of the key in the HashDisk
+func bloomHash(key []byte) (h1, h2 uint32) {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return uint32(h), uint32(h>>32) | 1
+}
@@ -0,0 +1,63 @@
+package kvimd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bloom")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.bloom")
+
+	keys := 10000
+	b, clean, err := newBloomFilter(path, uint32(keys))
+	require.NoError(t, err)
+	require.False(t, clean) // New filter
+	require.NoError(t, b.Reset())
+
+	tests := make([]testCase, keys)
+	for i := range tests {
+		tests[i] = generateTestCase()
+		require.NoError(t, b.Add(tests[i].Key))
+	}
+	for _, test := range tests {
+		require.True(t, b.MayContain(test.Key))
+	}
+	falsePositives := 0
+	for i := 0; i < keys; i++ {
+		if b.MayContain(generateTestCase().Key) {
+			falsePositives++
+		}
+	}
+	require.True(t, falsePositives < keys*3/100, "%d false positives", falsePositives)
+	require.NoError(t, b.Close())
+
+	// Closed properly, it is clean
+	b, clean, err = newBloomFilter(path, uint32(keys))
+	require.NoError(t, err)
+	require.True(t, clean)
+	for _, test := range tests {
+		require.True(t, b.MayContain(test.Key))
+	}
+	require.NoError(t, b.Add(generateTestCase().Key))
+	// Simulate a crash after a modification: the filter was not closed
+	require.NoError(t, b.m.Flush())
+	require.NoError(t, b.m.Unmap())
+	require.NoError(t, b.file.Close())
+	b, clean, err = newBloomFilter(path, uint32(keys))
+	require.NoError(t, err)
+	require.False(t, clean)
+	require.NoError(t, b.Close())
+
+	// A filter of a different size is not reused
+	b, clean, err = newBloomFilter(path, uint32(2*keys))
+	require.NoError(t, err)
+	require.False(t, clean)
+	require.NoError(t, b.Close())
+}
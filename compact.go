@@ -0,0 +1,201 @@
+package kvimd
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// maxFileSize is the maximum size of a HashDisk or a ValuesDisk when offsets in files are uint32
+const maxFileSize = 2<<31 - 1
+
+// Compact merges the HashDisks that are not written to anymore into a single one, so that lookups
+// don't need to probe as many of them. The new HashDisk is sized for the keys it holds (if they don't all fit
+// in a single file, only the oldest HashDisks are merged). It is as loaded as a HashDisk when it is rotated.
+// It is safe to call it concurrently with reads and writes, the old HashDisks are swapped for the new one
+// atomically. Their files are deleted once no reader (Iterate, Scan) uses them anymore.
+// If we crash while compacting, the database is opened as it was before (or after) the compaction.
+// Close waits for Compact to return
+func (d *DB) Compact() error {
+	d.compactMutex.Lock()
+	defer d.compactMutex.Unlock()
+	// Make sure the old HashDisks are not closed while we read them
+	if !d.leases.acquire() {
+		return ErrDBClosed
+	}
+	defer d.leases.release()
+
+	d.openHashDiskMutex.RLock()
+	if len(d.openHashDisk) == 0 {
+		d.openHashDiskMutex.RUnlock()
+		return ErrDBClosed
+	}
+	sealed := append([]*hashDisk(nil), d.openHashDisk[:len(d.openHashDisk)-1]...)
+	d.openHashDiskMutex.RUnlock()
+
+	// Merge as many HashDisks as fit in a file, from the oldest
+	var merged []*hashDisk
+	var keys uint64
+	for _, hd := range sealed {
+		n := hd.Len()
+		if compactedHashDiskSize(keys+uint64(n), d.hashDiskConfig()) >= d.maxHashDiskSize {
+			break
+		}
+		merged = append(merged, hd)
+		keys += uint64(n)
+	}
+	if len(merged) < 2 {
+		return nil // Nothing to merge
+	}
+
+	// Reserve the index of the new HashDisk. Holding rotateMutex makes sure rotate doesn't pick the same one
+	var index uint32
+	d.rotateMutex.Lock()
+	err := d.updateManifest(func(m *manifest) {
+		index = m.nextHashDisk()
+		m.Pending = append(m.Pending, createHashDiskPath(index))
+	})
+	d.rotateMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	file := createHashDiskPath(index)
+
+	hd, err := d.buildCompactedHashDisk(filepath.Join(d.RootPath, file), index, keys, merged)
+	if err == nil {
+		err = d.updateManifest(func(m *manifest) {
+			m.Pending = removeFile(m.Pending, file)
+			m.HashDisks = replaceHashDisks(m.HashDisks, merged, index)
+			for _, old := range merged {
+				m.Obsolete = append(m.Obsolete, createHashDiskPath(old.FileIndex))
+			}
+		})
+	}
+	if err != nil {
+		// Nothing references the new file, remove it
+		if hd != nil {
+			hd.Close()
+		}
+		os.Remove(filepath.Join(d.RootPath, file))
+		os.Remove(filepath.Join(d.RootPath, createBloomPath(index)))
+		d.updateManifest(func(m *manifest) {
+			m.Pending = removeFile(m.Pending, file)
+		})
+		return errors.Wrap(err, "failed to compact HashDisks")
+	}
+
+	// Swap the HashDisks
+	d.openHashDiskMutex.Lock()
+	if atomic.LoadUint32(&d.closed) > 0 {
+		// The manifest already has the new HashDisk, the old ones will be deleted on the next open
+		d.openHashDiskMutex.Unlock()
+		hd.Close()
+		return ErrDBClosed
+	}
+	isMerged := make(map[*hashDisk]bool)
+	for _, old := range merged {
+		isMerged[old] = true
+	}
+	hashDisks := make([]*hashDisk, 0, len(d.openHashDisk)-len(merged)+1)
+	for _, h := range d.openHashDisk {
+		if !isMerged[h] {
+			hashDisks = append(hashDisks, h)
+		} else if h == merged[0] {
+			hashDisks = append(hashDisks, hd) // The new one takes the place of the oldest one
+		}
+	}
+	d.openHashDisk = hashDisks
+	d.openHashDiskMutex.Unlock()
+
+	// Iterate and Scan might still be using the old HashDisks (and their sorted runs). At the latest, they are
+	// removed when we release our own lease
+	d.leases.afterRelease(func() {
+		if err := d.removeHashDisks(merged); err != nil {
+			d.backgroundError(errors.Wrap(err, "failed to remove compacted HashDisks"))
+		}
+	})
+	return nil
+}
+
+// buildCompactedHashDisk creates the HashDisk at path with all the keys of hashDisks and flushes it to disk
+func (d *DB) buildCompactedHashDisk(path string, index uint32, keys uint64, hashDisks []*hashDisk) (*hashDisk, error) {
+	hd, err := newHashDisk(path, compactedHashDiskSize(keys, d.hashDiskConfig()), index, d.hashDiskConfig())
+	if err != nil {
+		return nil, err
+	}
+	// Nobody writes to the old ones anymore and nobody knows about the new one yet
+	for _, old := range hashDisks {
+		old.RLock()
+		for slot := uint32(0); slot < old.Slots(); slot++ {
+			key, fileIndex, fileOffset, ok := old.Entry(slot)
+			if !ok {
+				continue
+			}
+			if err = hd.Set(key, fileIndex, fileOffset); err != nil {
+				break
+			}
+		}
+		old.RUnlock()
+		if err != nil {
+			return hd, err
+		}
+	}
+	// It must be on disk before the manifest references it instead of the old ones
+	return hd, hd.Sync()
+}
+
+// removeHashDisks closes hashDisks and deletes their files (and the files derived from them)
+func (d *DB) removeHashDisks(hashDisks []*hashDisk) error {
+	var errs []error
+	var files []string
+	d.sortedRunsMutex.Lock()
+	for _, hd := range hashDisks {
+		errs = append(errs, hd.Close())
+		if r := d.sortedRuns[hd.FileIndex]; r != nil {
+			errs = append(errs, r.Close())
+			delete(d.sortedRuns, hd.FileIndex)
+		}
+		files = append(files, createHashDiskPath(hd.FileIndex))
+		for _, f := range []string{createHashDiskPath(hd.FileIndex), createBloomPath(hd.FileIndex), createSortedRunPath(hd.FileIndex)} {
+			if err := os.Remove(filepath.Join(d.RootPath, f)); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	d.sortedRunsMutex.Unlock()
+	if err := firstError(errs...); err != nil {
+		return err // They will be deleted on the next open
+	}
+	return d.updateManifest(func(m *manifest) {
+		for _, f := range files {
+			m.Obsolete = removeFile(m.Obsolete, f)
+		}
+	})
+}
+
+// compactedHashDiskSize returns the size of a HashDisk holding keys keys that is as loaded as a rotated one
+func compactedHashDiskSize(keys uint64, config hashDiskConfig) int64 {
+	entrySize, load := config.layout()
+	slots := uint64(float64(keys)/(rotateHashDiskMaxLoad*load)) + 1
+	return int64(slots * uint64(entrySize))
+}
+
+// replaceHashDisks returns indexes where the indexes of merged are replaced by index
+// (at the position of the first one)
+func replaceHashDisks(indexes []uint32, merged []*hashDisk, index uint32) []uint32 {
+	isMerged := make(map[uint32]bool)
+	for _, hd := range merged {
+		isMerged[hd.FileIndex] = true
+	}
+	ret := make([]uint32, 0, len(indexes))
+	for _, i := range indexes {
+		if !isMerged[i] {
+			ret = append(ret, i)
+		} else if i == merged[0].FileIndex {
+			ret = append(ret, index)
+		}
+	}
+	return ret
+}
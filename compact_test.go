@@ -0,0 +1,150 @@
+package kvimd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Small files so that we have many HashDisks
+	db, err := NewDB(dir, Options{FileSize: 1 << 20})
+	require.NoError(t, err)
+	tests := make([]kvimdTestCase, 80000)
+	keys := make([][]byte, len(tests))
+	values := make([][]byte, len(tests))
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		keys[i], values[i] = tests[i].Key, tests[i].Value
+	}
+	_, err = db.WriteBatch(keys, values)
+	require.NoError(t, err)
+	old := append([]uint32(nil), db.manifest.HashDisks...)
+	require.True(t, len(old) > 2)
+
+	// A running iteration keeps the old files alive
+	iterating := make(chan struct{})
+	resume := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		first := true
+		err := db.IterateKeys(func(key []byte) error {
+			if first {
+				first = false
+				close(iterating)
+				<-resume
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}()
+	<-iterating
+
+	require.NoError(t, db.Compact())
+	require.Len(t, db.manifest.HashDisks, 2)
+	require.Equal(t, old[len(old)-1], db.manifest.HashDisks[1]) // We still write to the same one
+	require.Len(t, db.openHashDisk, 2)
+	_, err = os.Stat(filepath.Join(dir, createHashDiskPath(old[0])))
+	require.NoError(t, err)
+	require.Len(t, db.manifest.Obsolete, len(old)-1)
+
+	close(resume)
+	wg.Wait()
+	for _, index := range old[:len(old)-1] {
+		for _, f := range []string{createHashDiskPath(index), createBloomPath(index)} {
+			_, err = os.Stat(filepath.Join(dir, f))
+			require.True(t, os.IsNotExist(err))
+		}
+	}
+	require.Empty(t, db.manifest.Obsolete)
+
+	// Everything is still there, and we can keep writing
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+	for i := 0; i < 1000; i++ {
+		test := generateKvimdTest()
+		require.NoError(t, db.Write(test.Key, test.Value))
+		tests = append(tests, test)
+	}
+	require.NoError(t, db.Compact()) // Nothing to compact
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, Options{})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+}
+
+func TestCompactConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: 1 << 20})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// Generated beforehand, randbo is not safe for concurrent use
+	tests := make([]kvimdTestCase, 40000)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(tests []kvimdTestCase) {
+			defer wg.Done()
+			for _, test := range tests {
+				if err := db.Write(test.Key, test.Value); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(tests[w*10000 : (w+1)*10000])
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for compacting := true; compacting; {
+		select {
+		case <-done:
+			compacting = false
+		default:
+		}
+		require.NoError(t, db.Compact())
+	}
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+}
@@ -0,0 +1,73 @@
+package kvimd
+
+import "fmt"
+
+// Logger receives the messages of the database: files that are rotated, errors of the background goroutines...
+// Messages don't end with a newline. It must be safe to call concurrently
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdoutLogger is the default Logger, it prints every message to stdout
+type stdoutLogger struct{}
+
+func (stdoutLogger) Infof(format string, args ...interface{}) {
+	fmt.Printf("kvimd: "+format+"\n", args...)
+}
+
+func (stdoutLogger) Errorf(format string, args ...interface{}) {
+	fmt.Printf("kvimd: "+format+"\n", args...)
+}
+
+// RotateEvent is sent when a file is full and a new one is created to replace it
+type RotateEvent struct {
+	Full string // The file that was full (e.g: db0.hashdisk)
+	New  string // The file that was created (e.g: db1.hashdisk)
+}
+
+// RecoverEvent is sent when the write-ahead log had writes to replay on open (we didn't close cleanly)
+type RecoverEvent struct {
+	Writes    int   // Number of writes replayed
+	Truncated int64 // Size (in bytes) of the records that were torn by the crash and removed from the end of the log
+}
+
+// Hooks are called on the events of the database. Any of them can be nil.
+// They are called synchronously from the goroutine where the event happens so they must return quickly
+// and must not call the database (except OnCorruption and OnBackgroundError)
+type Hooks struct {
+	// OnRotate is called after a HashDisk or a ValuesDisk was rotated
+	OnRotate func(e RotateEvent)
+	// OnRecover is called when writes of the write-ahead log were replayed on open
+	OnRecover func(e RecoverEvent)
+	// OnCorruption is called when a value read from disk doesn't match its checksum, before the error is returned.
+	// The reader released its locks (and lease) before so it can call the database, even Close
+	OnCorruption func(err *CorruptedError)
+	// OnBackgroundError is called when a background task (rotation, sync, checkpoint, removal of compacted files) fails.
+	// The task is retried later so the database can still be used
+	OnBackgroundError func(err error)
+}
+
+func (h Hooks) rotate(e RotateEvent) {
+	if h.OnRotate != nil {
+		h.OnRotate(e)
+	}
+}
+
+func (h Hooks) recover(e RecoverEvent) {
+	if h.OnRecover != nil {
+		h.OnRecover(e)
+	}
+}
+
+func (h Hooks) corruption(err *CorruptedError) {
+	if h.OnCorruption != nil {
+		h.OnCorruption(err)
+	}
+}
+
+func (h Hooks) backgroundError(err error) {
+	if h.OnBackgroundError != nil {
+		h.OnBackgroundError(err)
+	}
+}
@@ -0,0 +1,223 @@
+package kvimd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// testLogger keeps all the messages it receives
+type testLogger struct {
+	mutex  sync.Mutex
+	infos  []string
+	errors []string
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func TestEventsRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := &testLogger{}
+	var mutex sync.Mutex
+	var events []RotateEvent
+	hooks := Hooks{OnRotate: func(e RotateEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, e)
+	}}
+	db, err := NewDB(dir, Options{FileSize: 1 << 20, Logger: logger, Hooks: hooks})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+
+	keys := make([][]byte, 40000)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		test := generateKvimdTest()
+		keys[i], values[i] = test.Key, test.Value
+	}
+	_, err = db.WriteBatch(keys, values)
+	require.NoError(t, err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Contains(t, events, RotateEvent{Full: "db0.hashdisk", New: "db1.hashdisk"})
+	require.Contains(t, events, RotateEvent{Full: "db0.valuesdisk", New: "db1.valuesdisk"})
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	require.Contains(t, logger.infos, "HashDisk database is full, creating a new one")
+	require.Contains(t, logger.infos, "ValuesDisk database is full, creating a new one")
+}
+
+func TestEventsRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var events []RecoverEvent
+	opts := Options{
+		FileSize:      testFileSize,
+		WriteAheadLog: true,
+		Logger:        &testLogger{},
+		Hooks:         Hooks{OnRecover: func(e RecoverEvent) { events = append(events, e) }},
+	}
+	db, err := NewDB(dir, opts)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		test := generateKvimdTest()
+		err = db.Write(test.Key, test.Value)
+		require.NoError(t, err)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(dir, walFile))
+	require.NoError(t, err)
+	err = db.Close()
+	require.NoError(t, err)
+	// A clean close leaves nothing to recover
+	db, err = NewDB(dir, opts)
+	require.NoError(t, err)
+	err = db.Close()
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// Simulate a crash during the last write
+	err = ioutil.WriteFile(filepath.Join(dir, walFile), append(log, 0x01, 0x02, 0x03), 0644)
+	require.NoError(t, err)
+	db, err = NewDB(dir, opts)
+	require.NoError(t, err)
+	err = db.Close()
+	require.NoError(t, err)
+	require.Equal(t, []RecoverEvent{{Writes: 10, Truncated: 3}}, events)
+}
+
+func TestEventsCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var corrupted []*CorruptedError
+	hooks := Hooks{OnCorruption: func(err *CorruptedError) { corrupted = append(corrupted, err) }}
+	db, err := NewDB(dir, Options{FileSize: testFileSize, Logger: &testLogger{}, Hooks: hooks})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+
+	test := generateKvimdTest()
+	err = db.Write(test.Key, []byte("immutable value"))
+	require.NoError(t, err)
+	location, err := db.Locate(test.Key)
+	require.NoError(t, err)
+	db.openValuesDisk[location.FileIndex].m[int(location.FileOffset)+1] ^= 0x01 // Flip a bit of the value
+
+	_, err = db.Read(test.Key)
+	require.Equal(t, ErrCorrupted, errors.Cause(err))
+	_, errs, err := db.ReadMany([][]byte{test.Key})
+	require.NoError(t, err)
+	require.Equal(t, ErrCorrupted, errors.Cause(errs[0]))
+	err = db.View(test.Key, func(value []byte) error { return nil })
+	require.Equal(t, ErrCorrupted, errors.Cause(err))
+	require.Len(t, corrupted, 3)
+	for _, c := range corrupted {
+		require.Equal(t, location.FileIndex, c.FileIndex)
+		require.Equal(t, location.FileOffset, c.FileOffset)
+	}
+}
+
+func TestEventsCorruptionReentrant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The hook is called once the locks are released so it can use the database
+	var db *DB
+	var calls int
+	var hookErrs []error
+	hooks := Hooks{OnCorruption: func(*CorruptedError) {
+		calls++
+		test := generateKvimdTest()
+		hookErrs = append(hookErrs, db.Write(test.Key, test.Value))
+		_, err := db.Read(test.Key)
+		hookErrs = append(hookErrs, err)
+	}}
+	db, err = NewDB(dir, Options{FileSize: testFileSize, Logger: &testLogger{}, Hooks: hooks})
+	require.NoError(t, err)
+
+	test := generateKvimdTest()
+	require.NoError(t, db.Write(test.Key, []byte("immutable value")))
+	location, err := db.Locate(test.Key)
+	require.NoError(t, err)
+	db.openValuesDisk[location.FileIndex].m[int(location.FileOffset)+1] ^= 0x01 // Flip a bit of the value
+
+	_, err = db.Read(test.Key)
+	require.Equal(t, ErrCorrupted, errors.Cause(err))
+	_, errs, err := db.ReadMany([][]byte{test.Key})
+	require.NoError(t, err)
+	require.Equal(t, ErrCorrupted, errors.Cause(errs[0]))
+	err = db.View(test.Key, func(value []byte) error { return nil })
+	require.Equal(t, ErrCorrupted, errors.Cause(err))
+	_, err = db.Open(test.Key)
+	require.Equal(t, ErrCorrupted, errors.Cause(err))
+	err = db.Iterate(func(key, value []byte) error { return nil })
+	require.Equal(t, ErrCorrupted, errors.Cause(err))
+	err = db.Scan(nil, nil, func(key, value []byte) error { return nil })
+	require.Equal(t, ErrCorrupted, errors.Cause(err))
+	require.Equal(t, 6, calls)
+	for _, err := range hookErrs {
+		require.NoError(t, err)
+	}
+
+	// Even Close
+	db.hooks.OnCorruption = func(*CorruptedError) {
+		hookErrs = append(hookErrs[:0], db.Close())
+	}
+	_, err = db.Read(test.Key)
+	require.Equal(t, ErrCorrupted, errors.Cause(err))
+	require.Equal(t, []error{nil}, hookErrs)
+	_, err = db.Read(test.Key)
+	require.Equal(t, ErrDBClosed, err)
+}
+
+func TestEventsBackgroundError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := &testLogger{}
+	var errs []error
+	hooks := Hooks{OnBackgroundError: func(err error) { errs = append(errs, err) }}
+	db, err := NewDB(dir, Options{FileSize: testFileSize, Logger: logger, Hooks: hooks})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+
+	db.backgroundError(errors.Wrap(ErrNoSpace, "failed to create new databases"))
+	require.Len(t, errs, 1)
+	require.Equal(t, ErrNoSpace, errors.Cause(errs[0]))
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	require.Equal(t, []string{"failed to create new databases: " + ErrNoSpace.Error()}, logger.errors)
+}
@@ -3,10 +3,14 @@ package kvimd
 import (
 	"bytes"
 	"encoding/binary"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 
-	"github.com/DataDog/hyperloglog"
 	"github.com/edsrzf/mmap-go"
 	"github.com/pkg/errors"
 )
@@ -14,6 +18,10 @@ import (
 const (
 	// maxLoad is the load after the one, we will not accept Set anymore
 	maxLoad = 0.8
+	// maxLoadRobinHood is maxLoad with Robin Hood probing
+	maxLoadRobinHood = 0.95
+	// hashDiskStripes is the number of locks of a hashDisk with concurrent Set (see hashDisk.stripe)
+	hashDiskStripes = 1024
 )
 
 var (
@@ -21,20 +29,91 @@ var (
 )
 
 // hashDisk represents a HashMap of constant key and value size.
-// It uses mmap internally. It is **NOT THREAD-SAFE** (you need to acquire hashDisk.Lock())
+// The key size, the probing, the hasher and the size of the offsets are given at creation and must be the same
+// every time the file is reopened. An entry is a key, a ValuesDisk index (uint32) and an offset in it (uint32, or
+// uint64 with large files). With ProbingRobinHood, each entry is followed by its distance to its slot (uint32)
+// and Set moves entries around.
+// It uses mmap internally. Set, Get, Len and Load are thread-safe:
+//   - With linear probing (and a key size that is a multiple of 4), Set locks the slots it looks at one at a time
+//     (striped locks) so that writers of different slots don't wait for each other. An entry is published
+//     with atomic stores so that Get can probe without any lock, it only takes the lock of the slot where it
+//     finds its key (which could be partly published)
+//   - Otherwise Set takes the write lock of the hashDisk and Get its read lock
+//
+// Scanning the slots (Entry, ScanSlots) needs a read lock, it only keeps Set from moving entries
 type hashDisk struct {
 	sync.RWMutex
-	MaxSize uint32 // Max number of items we can add into the hash. This is computed by the map itself
+	FileIndex uint32
+	MaxSize   uint32 // Max number of items we can add into the hash. This is computed by the map itself
 
 	emptyValue   []byte
+	robinHood    bool
+	concurrent   bool // Set uses the striped locks and Get doesn't lock
+	stripes      []sync.Mutex
+	hasher       Hasher
+	keySize      uint32
+	offsetSize   uint32 // 4 or 8 bytes (large files)
 	entries      uint32
 	entrySize    uint32
-	totalEntries uint32
+	totalEntries uint32          // Accessed atomically
+	references   map[uint32]bool // ValuesDisks referenced by the entries when the file was opened
 	file         *os.File
 	m            mmap.MMap
+	bloom        *bloomFilter // Every key of the hashmap is in it
+	// With tracking set (accessed atomically), Set appends the entries it adds to added (encoded as in a sorted run)
+	// so that the sorted run of the hashmap can be updated without building it again (see TrackAdded)
+	tracking   uint32
+	addedMutex sync.Mutex
+	added      []byte
 }
 
-func newHashDisk(path string, size int64) (*hashDisk, error) {
+// hashDiskConfig is how a hashDisk is laid out. It must be the same every time the file is opened
+type hashDiskConfig struct {
+	KeySize    int
+	Probing    Probing
+	Hasher     Hasher
+	LargeFiles bool // Offsets in ValuesDisks are uint64
+}
+
+// offsetSize returns the size of the offset of a value in its ValuesDisk
+func (c hashDiskConfig) offsetSize() uint32 {
+	if c.LargeFiles {
+		return 8
+	}
+	return 4
+}
+
+// maxFileSize returns the size from which a file can't be addressed: with uint32 offsets, it is 4Gb.
+// With large files, the values can be anywhere in the ValuesDisks but a hashDisk can't have more than 1<<32 slots
+func (c hashDiskConfig) maxFileSize() int64 {
+	if !c.LargeFiles {
+		return maxFileSize
+	}
+	entrySize, _ := c.layout()
+	return math.MaxUint32 * int64(entrySize)
+}
+
+// hashDiskSizeFor returns the size of a hashDisk that is rotated at the same time as a ValuesDisk of size valuesDiskSize
+// holding values of averageValueSize bytes (smaller than maxSize)
+func hashDiskSizeFor(valuesDiskSize int64, averageValueSize int, config hashDiskConfig, maxSize int64) int64 {
+	keys := uint64(float64(valuesDiskSize) * rotateValuesDiskMaxLoad / float64(recordSize(averageValueSize)))
+	size := compactedHashDiskSize(keys, config)
+	if size >= maxSize {
+		return maxSize - 1
+	}
+	return size
+}
+
+// layout returns the size of an entry and the max load of a hashDisk
+func (c hashDiskConfig) layout() (entrySize uint32, load float64) {
+	entrySize = uint32(c.KeySize) + 4 + c.offsetSize() // An entry is a key, file_index, index_in_file
+	if c.Probing == ProbingRobinHood {
+		return entrySize + 4, maxLoadRobinHood // And its distance to its slot
+	}
+	return entrySize, maxLoad
+}
+
+func newHashDisk(path string, size int64, fileIndex uint32, config hashDiskConfig) (*hashDisk, error) {
 	// Open or create the file
 	f, err := os.OpenFile(path, os.O_RDWR, 0755)
 	if os.IsNotExist(err) {
@@ -57,8 +136,12 @@ func newHashDisk(path string, size int64) (*hashDisk, error) {
 		return nil, errors.Wrap(err, "failed to get file infos")
 	}
 	size = info.Size()
-	entrySize := uint32(keySize + 4 + 4) // An entry is a key, file_index, index_in_file
-	entries := uint32(size) / entrySize
+	entrySize, load := config.layout()
+	if size/int64(entrySize) > math.MaxUint32 {
+		f.Close()
+		return nil, ErrFileTooBig
+	}
+	entries := uint32(size / int64(entrySize))
 
 	// Mmap the file
 	m, err := mmap.Map(f, mmap.RDWR, 0)
@@ -67,84 +150,411 @@ func newHashDisk(path string, size int64) (*hashDisk, error) {
 		return nil, errors.Wrap(err, "failed to mmap file")
 	}
 
-	return &hashDisk{
-		MaxSize:    uint32(maxLoad * float64(entries)),
-		emptyValue: make([]byte, keySize),
+	// Open its bloom filter (next to it, with the .bloom extension)
+	bloomPath := strings.TrimSuffix(path, filepath.Ext(path)) + bloomExtension
+	bloom, clean, err := newBloomFilter(bloomPath, uint32(load*float64(entries)))
+	if err != nil {
+		m.Unmap()
+		f.Close()
+		return nil, errors.Wrap(err, "failed to open bloom filter")
+	}
+	if !clean {
+		// We don't know whether it has all the keys, rebuild it while counting them
+		if err := bloom.Reset(); err != nil {
+			bloom.Close()
+			m.Unmap()
+			f.Close()
+			return nil, errors.Wrap(err, "failed to reset bloom filter")
+		}
+	}
+
+	h := &hashDisk{
+		FileIndex:  fileIndex,
+		MaxSize:    uint32(load * float64(entries)),
+		emptyValue: make([]byte, config.KeySize),
+		robinHood:  config.Probing == ProbingRobinHood,
+		// Atomic operations need 4-byte aligned words (the mmap is page aligned)
+		concurrent: config.Probing == ProbingLinear && config.KeySize%4 == 0,
+		hasher:     config.Hasher,
+		keySize:    uint32(config.KeySize),
+		offsetSize: config.offsetSize(),
 		entries:    entries,
 		entrySize:  entrySize,
 		file:       f,
 		m:          m,
-	}, nil
+		bloom:      bloom,
+	}
+	if h.concurrent {
+		h.stripes = make([]sync.Mutex, hashDiskStripes)
+	}
+	if clean {
+		h.totalEntries, h.references = h.scanEntries(nil)
+	} else {
+		h.totalEntries, h.references = h.scanEntries(bloom)
+	}
+	return h, nil
 }
 
-// Load returns the load factor of the hashmap.
-// If accessed concurrently you need a read lock
+// scanEntries returns the number of occupied slots of the hashmap and the ValuesDisks they reference,
+// adding their keys to bloom if it is not nil.
+// It scans the whole file so it should only be used when opening it
+func (h *hashDisk) scanEntries(bloom *bloomFilter) (count uint32, references map[uint32]bool) {
+	references = make(map[uint32]bool)
+	for slot := uint32(0); slot < h.entries; slot++ {
+		offset := h.offset(slot)
+		key := h.m[offset : offset+uint64(h.keySize)]
+		if !bytes.Equal(key, h.emptyValue) {
+			count++
+			fileIndex, _ := h.location(h.m[offset+uint64(h.keySize):])
+			references[fileIndex] = true
+			if bloom != nil {
+				bloom.Add(key) // Can't fail, Reset already marked it dirty
+			}
+		}
+	}
+	return count, references
+}
+
+// References returns the indexes of the ValuesDisks referenced by the entries of the hashmap when it was opened
+func (h *hashDisk) References() []uint32 {
+	indexes := make([]uint32, 0, len(h.references))
+	for index := range h.references {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes
+}
+
+// offset returns where the entry of slot starts in the file
+func (h *hashDisk) offset(slot uint32) uint64 {
+	return uint64(slot) * uint64(h.entrySize)
+}
+
+// location decodes the location of a value at the beginning of b (the entry after its key)
+func (h *hashDisk) location(b []byte) (fileIndex uint32, fileOffset uint64) {
+	fileIndex = encoding.Uint32(b[0:4])
+	if h.offsetSize == 8 {
+		return fileIndex, encoding.Uint64(b[4:12])
+	}
+	return fileIndex, uint64(encoding.Uint32(b[4:8]))
+}
+
+// putLocation encodes the location of a value at the beginning of b (the entry after its key)
+func (h *hashDisk) putLocation(b []byte, fileIndex uint32, fileOffset uint64) {
+	encoding.PutUint32(b[0:4], fileIndex)
+	if h.offsetSize == 8 {
+		encoding.PutUint64(b[4:12], fileOffset)
+		return
+	}
+	encoding.PutUint32(b[4:8], uint32(fileOffset))
+}
+
+// slot returns the slot where the search for key starts
+func (h *hashDisk) slot(key []byte) uint32 {
+	return uint32(h.hasher.Hash(key) % uint64(h.entries))
+}
+
+// stripe returns the lock of slot (only with concurrent Set). Consecutive slots have different locks
+func (h *hashDisk) stripe(slot uint32) *sync.Mutex {
+	return &h.stripes[slot%hashDiskStripes]
+}
+
+// Load returns the load factor of the hashmap
 func (h *hashDisk) Load() float64 {
-	return float64(h.totalEntries) / float64(h.MaxSize)
+	return float64(atomic.LoadUint32(&h.totalEntries)) / float64(h.MaxSize)
 }
 
-// Set a given value that was stored in another database at fileIndex and fileOffset
-// If accessed concurrently you need a write lock
-func (h *hashDisk) Set(value []byte, fileIndex, fileOffset uint32) error {
-	if bytes.Equal(value, h.emptyValue) {
+// Len returns the number of keys in the hashmap
+func (h *hashDisk) Len() uint32 {
+	return atomic.LoadUint32(&h.totalEntries)
+}
+
+// Set a given value that was stored in another database at fileIndex and fileOffset.
+// With linear probing, if value is already there it keeps its location (Get doesn't lock so
+// a published entry never changes). With Robin Hood probing, its location is overridden
+func (h *hashDisk) Set(value []byte, fileIndex uint32, fileOffset uint64) error {
+	if len(value) != int(h.keySize) || bytes.Equal(value, h.emptyValue) {
 		return ErrInvalidKey
 	}
-	if h.totalEntries >= h.MaxSize {
+	if !h.concurrent {
+		h.Lock()
+		defer h.Unlock()
+	}
+	// Reserve the space of a new entry, it is given back if value is already there
+	if atomic.AddUint32(&h.totalEntries, 1) > h.MaxSize {
+		atomic.AddUint32(&h.totalEntries, ^uint32(0))
 		return ErrNoSpace
 	}
-	newEntry := true
-	// Compute hash
-	slot := hyperloglog.MurmurBytes(value) % h.entries
-	offset := slot * h.entrySize
+	if err := h.bloom.Add(value); err != nil {
+		atomic.AddUint32(&h.totalEntries, ^uint32(0))
+		return err
+	}
+	var newEntry bool
+	if h.robinHood {
+		newEntry = h.setRobinHood(value, fileIndex, fileOffset)
+	} else {
+		newEntry = h.setLinear(value, fileIndex, fileOffset)
+	}
+	if !newEntry {
+		atomic.AddUint32(&h.totalEntries, ^uint32(0))
+	} else if atomic.LoadUint32(&h.tracking) == 1 { // Only once the entry is published (see TrackAdded)
+		h.addedMutex.Lock()
+		h.added = appendRunEntry(h.added, value, fileIndex, fileOffset)
+		h.addedMutex.Unlock()
+	}
+	return nil
+}
+
+// TrackAdded makes Set keep the entries it adds from now on, until they are taken with TakeAdded.
+// An entry that is published concurrently is either tracked or in the hashmap once TrackAdded returned
+// (Set checks whether it is tracking after publishing), so building a sorted run after calling it and merging
+// what is taken later misses nothing (but the same entry can be in both)
+func (h *hashDisk) TrackAdded() {
+	h.addedMutex.Lock()
+	h.added = nil
+	h.addedMutex.Unlock()
+	atomic.StoreUint32(&h.tracking, 1)
+}
+
+// TakeAdded returns the entries added since TrackAdded or the last call (and forgets them).
+// tracked is false if TrackAdded wasn't called
+func (h *hashDisk) TakeAdded() (added []byte, tracked bool) {
+	h.addedMutex.Lock()
+	defer h.addedMutex.Unlock()
+	added, h.added = h.added, nil
+	return added, atomic.LoadUint32(&h.tracking) == 1
+}
+
+// UntrackAdded stops keeping the entries added by Set
+func (h *hashDisk) UntrackAdded() {
+	atomic.StoreUint32(&h.tracking, 0)
+	h.addedMutex.Lock()
+	h.added = nil
+	h.addedMutex.Unlock()
+}
+
+// setLinear is Set with linear probing. Return whether value was not there yet
+func (h *hashDisk) setLinear(value []byte, fileIndex uint32, fileOffset uint64) bool {
+	slot := h.slot(value)
 	for { // Try to find an empty slot
-		slotValue := h.m[offset : offset+keySize]
-		if bytes.Equal(slotValue, value) {
-			// Found same key, override. We could just return instead but it was found in
-			// benchmarks that it hardly change anything at all so it's better to be able to override
-			newEntry = false
-			break
+		if h.concurrent {
+			h.stripe(slot).Lock()
+		}
+		// Nobody else writes to the slot while we hold its lock
+		offset := h.offset(slot)
+		slotValue := h.m[offset : offset+uint64(h.keySize)]
+		empty := bytes.Equal(slotValue, h.emptyValue)
+		if empty {
+			h.publish(offset, value, fileIndex, fileOffset)
+		}
+		found := empty || bytes.Equal(slotValue, value)
+		if h.concurrent {
+			h.stripe(slot).Unlock()
 		}
+		if found {
+			return empty
+		}
+		slot = (slot + 1) % h.entries
+	}
+}
+
+// publish writes the entry of value in the empty slot at offset. With concurrent Set, it is written with atomic
+// stores, its location before its key: a reader that sees the whole key also sees its location
+func (h *hashDisk) publish(offset uint64, value []byte, fileIndex uint32, fileOffset uint64) {
+	keySize := uint64(h.keySize)
+	if !h.concurrent {
+		copy(h.m[offset:offset+keySize], value)
+		h.putLocation(h.m[offset+keySize:], fileIndex, fileOffset)
+		return
+	}
+	// An uint64 offset might not be 8-byte aligned, it is stored as 2 words (little endian)
+	atomicStoreUint32(h.m, offset+keySize, fileIndex)
+	atomicStoreUint32(h.m, offset+keySize+4, uint32(fileOffset))
+	if h.offsetSize == 8 {
+		atomicStoreUint32(h.m, offset+keySize+8, uint32(fileOffset>>32))
+	}
+	for i := uint64(0); i < keySize; i += 4 {
+		atomic.StoreUint32(wordAt(h.m, offset+i), nativeEndian.Uint32(value[i:i+4]))
+	}
+}
+
+// confirmKey returns whether value is in slot and the location of its value (with concurrent Set).
+// Entries are published under the lock of their slot so holding it, we see them whole
+func (h *hashDisk) confirmKey(slot uint32, value []byte) (fileIndex uint32, fileOffset uint64, ok bool) {
+	h.stripe(slot).Lock()
+	defer h.stripe(slot).Unlock()
+	offset := h.offset(slot)
+	if !bytes.Equal(h.m[offset:offset+uint64(h.keySize)], value) {
+		return 0, 0, false
+	}
+	fileIndex, fileOffset = h.location(h.m[offset+uint64(h.keySize):])
+	return fileIndex, fileOffset, true
+}
+
+// compareKey returns whether the key in the slot at offset is value or is empty.
+// With concurrent Set, it is read with atomic loads so a key that is being published can be seen partly written:
+// as empty, as a different key or even as value if the words of value that are not written yet are zeros.
+// A match must be confirmed with confirmKey
+func (h *hashDisk) compareKey(offset uint64, value []byte) (equal, empty bool) {
+	if !h.concurrent {
+		slotValue := h.m[offset : offset+uint64(h.keySize)]
+		return bytes.Equal(slotValue, value), bytes.Equal(slotValue, h.emptyValue)
+	}
+	equal, empty = true, true
+	for i := uint64(0); i < uint64(h.keySize); i += 4 {
+		word := atomic.LoadUint32(wordAt(h.m, offset+i))
+		equal = equal && word == nativeEndian.Uint32(value[i:i+4])
+		empty = empty && word == 0
+	}
+	return equal, empty
+}
+
+// setRobinHood is Set with Robin Hood probing: while looking for an empty slot, if we find an entry that is closer
+// to its slot than the one we are inserting, we take its place and continue with it instead.
+// Return whether value was not there yet
+func (h *hashDisk) setRobinHood(value []byte, fileIndex uint32, fileOffset uint64) bool {
+	distanceOffset := h.keySize + 4 + h.offsetSize // The distance follows the key and the location
+	entry := make([]byte, h.entrySize)             // The entry we are currently inserting
+	copy(entry, value)
+	h.putLocation(entry[h.keySize:], fileIndex, fileOffset)
+	swapped := false // Once we swapped, the entry we insert can't be anywhere else in the table
+	tmp := make([]byte, h.entrySize)
+	slot := h.slot(value)
+	for distance := uint32(0); ; distance++ {
+		offset := h.offset(slot)
+		slotEntry := h.m[offset : offset+uint64(h.entrySize)]
+		slotValue := slotEntry[:h.keySize]
 		if bytes.Equal(slotValue, h.emptyValue) {
 			// Found empty slot
-			break
+			encoding.PutUint32(entry[distanceOffset:], distance)
+			copy(slotEntry, entry)
+			return true
+		}
+		if !swapped && bytes.Equal(slotValue, value) {
+			// Found same key, override
+			copy(slotEntry[h.keySize:distanceOffset], entry[h.keySize:distanceOffset])
+			return false
+		}
+		if slotDistance := encoding.Uint32(slotEntry[distanceOffset:]); slotDistance < distance {
+			// The entry in the slot is richer than us, take its place
+			encoding.PutUint32(entry[distanceOffset:], distance)
+			copy(tmp, slotEntry)
+			copy(slotEntry, entry)
+			entry, tmp = tmp, entry
+			distance = slotDistance
+			swapped = true
 		}
 		slot = (slot + 1) % h.entries
-		offset = slot * h.entrySize
-	}
-	// Insert
-	indexes := make([]byte, 4+4)
-	encoding.PutUint32(indexes[0:4], fileIndex)
-	encoding.PutUint32(indexes[4:8], fileOffset)
-	copy(h.m[offset:offset+keySize], value)
-	copy(h.m[offset+keySize:offset+keySize+8], indexes)
-	if newEntry {
-		h.totalEntries++
 	}
-	return nil
 }
 
 // Get the location of a value. If the value is not found, return a ErrKeyNotFound
-// If accessed concurrently you need a read lock
-func (h *hashDisk) Get(value []byte) (fileIndex, fileOffset uint32, err error) {
-	if bytes.Equal(value, h.emptyValue) {
+func (h *hashDisk) Get(value []byte) (fileIndex uint32, fileOffset uint64, err error) {
+	if len(value) != int(h.keySize) || bytes.Equal(value, h.emptyValue) {
 		return 0, 0, ErrInvalidKey
 	}
-	slot := hyperloglog.MurmurBytes(value) % h.entries
-	offset := slot * h.entrySize
-	for { // Try to find value or an empty slot
-		slotValue := h.m[offset : offset+keySize]
-		if bytes.Equal(slotValue, value) {
-			fileIndex = encoding.Uint32(h.m[offset+keySize : offset+keySize+4])
-			fileOffset = encoding.Uint32(h.m[offset+keySize+4 : offset+keySize+8])
+	if !h.concurrent {
+		h.RLock()
+		defer h.RUnlock()
+	}
+	if !h.bloom.MayContain(value) {
+		return 0, 0, ErrKeyNotFound
+	}
+	slot := h.slot(value)
+	offset := h.offset(slot)
+	for distance := uint32(0); ; distance++ { // Try to find value or an empty slot
+		equal, empty := h.compareKey(offset, value)
+		if equal && h.concurrent {
+			if fileIndex, fileOffset, equal = h.confirmKey(slot, value); equal {
+				return fileIndex, fileOffset, nil
+			}
+			// Another key was being published in the slot, keep looking
+		} else if equal {
+			fileIndex, fileOffset = h.location(h.m[offset+uint64(h.keySize):])
 			return fileIndex, fileOffset, nil
 		}
-		if bytes.Equal(slotValue, h.emptyValue) {
+		if empty {
 			// Found empty slot
 			return 0, 0, ErrKeyNotFound
 		}
+		if h.robinHood && h.distance(offset) < distance {
+			// With Robin Hood, the key would have taken the place of this richer entry
+			return 0, 0, ErrKeyNotFound
+		}
 		slot = (slot + 1) % h.entries
-		offset = slot * h.entrySize
+		offset = h.offset(slot)
+	}
+}
+
+// distance returns the distance of the entry at offset to its slot (only with Robin Hood probing)
+func (h *hashDisk) distance(offset uint64) uint32 {
+	return encoding.Uint32(h.m[offset+uint64(h.entrySize)-4 : offset+uint64(h.entrySize)])
+}
+
+// ScanSlots calls fn with the entries of the slots in [start, end), under a read lock (so fn must not block).
+// key points directly into the mmap, copy it if you need to keep it.
+// Scanning all the slots in consecutive ranges, concurrently with Set, sees every entry that was there before
+// exactly once. With Robin Hood probing, Set moves entries to the following slots (never past an empty one):
+// an entry is seen with the range of the slot where the search for its key starts, which may mean reading
+// past end up to the next empty slot
+func (h *hashDisk) ScanSlots(start, end uint32, fn func(key []byte, fileIndex uint32, fileOffset uint64)) {
+	h.RLock()
+	defer h.RUnlock()
+	if !h.robinHood {
+		for slot := start; slot < end; slot++ {
+			if key, fileIndex, fileOffset, ok := h.Entry(slot); ok {
+				fn(key, fileIndex, fileOffset)
+			}
+		}
+		return
 	}
+	slot := start
+	for scanned := uint32(0); scanned < h.entries; scanned++ {
+		key, fileIndex, fileOffset, ok := h.Entry(slot)
+		if !ok && scanned >= end-start {
+			return // Nothing of the range moved past this slot
+		}
+		if ok {
+			distance := uint64(h.distance(h.offset(slot)))
+			if home := (uint64(slot) + uint64(h.entries) - distance) % uint64(h.entries); home >= uint64(start) && home < uint64(end) {
+				fn(key, fileIndex, fileOffset)
+			}
+		}
+		slot = (slot + 1) % h.entries
+	}
+}
+
+// Size returns the size of the hashmap in bytes
+func (h *hashDisk) Size() int64 {
+	return int64(h.entries) * int64(h.entrySize)
+}
+
+// Slots returns the number of slots of the hashmap (occupied or not)
+func (h *hashDisk) Slots() uint32 {
+	return h.entries
+}
+
+// Entry returns the key stored at slot and the location of its value. ok is false if the slot is empty.
+// key points directly into the mmap, copy it if you need to keep it
+// If accessed concurrently you need a read lock
+func (h *hashDisk) Entry(slot uint32) (key []byte, fileIndex uint32, fileOffset uint64, ok bool) {
+	if h.concurrent {
+		// Don't read an entry that is being published
+		h.stripe(slot).Lock()
+		defer h.stripe(slot).Unlock()
+	}
+	offset := h.offset(slot)
+	key = h.m[offset : offset+uint64(h.keySize)]
+	if bytes.Equal(key, h.emptyValue) {
+		return nil, 0, 0, false
+	}
+	fileIndex, fileOffset = h.location(h.m[offset+uint64(h.keySize):])
+	return key, fileIndex, fileOffset, true
+}
+
+// Sync flushes all the changes to disk
+func (h *hashDisk) Sync() error {
+	return h.m.Flush()
 }
 
 // Close the database. It is not safe to call any Set or Get after calling Close
@@ -152,5 +562,6 @@ func (h *hashDisk) Get(value []byte) (fileIndex, fileOffset uint32, err error) {
 func (h *hashDisk) Close() error {
 	err1 := h.m.Unmap() // Flush mmap to the file
 	err2 := h.file.Close()
-	return firstError(err1, err2)
+	err3 := h.bloom.Close()
+	return firstError(err1, err2, err3)
 }
@@ -24,9 +24,8 @@ EXTENDED_BENCH_FILE=/tmp/results go test -run TestExtendedBench
 
 // Run one iteration of the benchmark, setting from minLoad to maxLoad
 // Return number of keys set
-func benchmarkHashDiskSetWithLoad(t *testing.T, minLoad, maxLoad float64) {
-	name := fmt.Sprintf("BenchmarkHashDiskSetWithLoad_%.2f-%.2f", minLoad, maxLoad)
-	itemSize := int64(keySize + 4 + 4) // Key + 2 uint32
+func benchmarkHashDiskSetWithLoad(t *testing.T, probing Probing, minLoad, maxLoad float64) {
+	name := fmt.Sprintf("BenchmarkHashDiskSetWithLoad_%s_%.2f-%.2f", probingName(probing), minLoad, maxLoad)
 	// Setup
 	dir, err := ioutil.TempDir("", "hashdisk")
 	if err != nil {
@@ -35,11 +34,12 @@ func benchmarkHashDiskSetWithLoad(t *testing.T, minLoad, maxLoad float64) {
 	defer os.RemoveAll(dir)
 	path := filepath.Join(dir, "test.hashdisk")
 
-	h, err := newHashDisk(path, benchFileSize)
+	h, err := newHashDisk(path, benchFileSize, 0, testHashDiskConfig(probing))
 	if err != nil {
 		t.Fatalf("couldn't create the DB: %s", err)
 	}
 	defer h.Close()
+	itemSize := int64(h.entrySize) // Key + 2 uint32 (+ probe distance)
 	// Forces hashDisk to allow load of up to 1
 	h.MaxSize = benchFileSize
 
@@ -49,17 +49,17 @@ func benchmarkHashDiskSetWithLoad(t *testing.T, minLoad, maxLoad float64) {
 		minItems = 1
 	}
 	maxItems := int(float64(benchFileSize/itemSize) * maxLoad)
-	value := make([]byte, keySize)
+	value := make([]byte, defaultKeySize)
 	for i := 1; i < minItems; i++ {
 		binary.LittleEndian.PutUint64(value, uint64(i))
-		h.Set(value, uint32(i), uint32(i)+3)
+		h.Set(value, uint32(i), uint64(i)+3)
 	}
 
 	start := time.Now()
 	// Loop
 	for i := minItems; i < maxItems; i++ {
 		binary.LittleEndian.PutUint64(value, uint64(i))
-		h.Set(value, uint32(i), uint32(i)+3)
+		h.Set(value, uint32(i), uint64(i)+3)
 	}
 	elapsed := time.Now().Sub(start)
 	writeExtendedBenchResult(name, maxItems-minItems, elapsed, itemSize)
@@ -70,22 +70,29 @@ func TestExtendedBenchHashDiskSetLoad(t *testing.T) {
 		t.Skip()
 	}
 	t.Run("Load_0-0.5", func(t *testing.T) {
-		benchmarkHashDiskSetWithLoad(t, 0, 0.5)
+		for _, probing := range []Probing{ProbingLinear, ProbingRobinHood} {
+			benchmarkHashDiskSetWithLoad(t, probing, 0, 0.5)
+		}
 	})
 	t.Run("Load_0.7-0.9", func(t *testing.T) {
-		benchmarkHashDiskSetWithLoad(t, 0.7, 0.9)
+		for _, probing := range []Probing{ProbingLinear, ProbingRobinHood} {
+			benchmarkHashDiskSetWithLoad(t, probing, 0.7, 0.9)
+		}
 	})
 	t.Run("Load_0.9-0.95", func(t *testing.T) {
-		benchmarkHashDiskSetWithLoad(t, 0.9, 0.95)
+		for _, probing := range []Probing{ProbingLinear, ProbingRobinHood} {
+			benchmarkHashDiskSetWithLoad(t, probing, 0.9, 0.95)
+		}
 	})
 	t.Run("Load_0.95-0.99", func(t *testing.T) {
-		benchmarkHashDiskSetWithLoad(t, 0.95, 0.99)
+		for _, probing := range []Probing{ProbingLinear, ProbingRobinHood} {
+			benchmarkHashDiskSetWithLoad(t, probing, 0.95, 0.99)
+		}
 	})
 }
 
-func benchmarkHashDiskGetWithLoad(t *testing.T, minLoad, maxLoad float64) {
-	name := fmt.Sprintf("BenchmarkHashDiskGetWithLoad_%.2f-%.2f", minLoad, maxLoad)
-	itemSize := int64(keySize + 4 + 4) // Key + 2 uint32
+func benchmarkHashDiskGetWithLoad(t *testing.T, probing Probing, minLoad, maxLoad float64) {
+	name := fmt.Sprintf("BenchmarkHashDiskGetWithLoad_%s_%.2f-%.2f", probingName(probing), minLoad, maxLoad)
 	// Setup
 	dir, err := ioutil.TempDir("", "hashdisk")
 	if err != nil {
@@ -94,11 +101,12 @@ func benchmarkHashDiskGetWithLoad(t *testing.T, minLoad, maxLoad float64) {
 	defer os.RemoveAll(dir)
 	path := filepath.Join(dir, "test.hashdisk")
 
-	h, err := newHashDisk(path, benchFileSize)
+	h, err := newHashDisk(path, benchFileSize, 0, testHashDiskConfig(probing))
 	if err != nil {
 		t.Fatalf("couldn't create the DB: %s", err)
 	}
 	defer h.Close()
+	itemSize := int64(h.entrySize) // Key + 2 uint32 (+ probe distance)
 	// Forces hashDisk to allow load of up to 1
 	h.MaxSize = benchFileSize
 
@@ -108,10 +116,10 @@ func benchmarkHashDiskGetWithLoad(t *testing.T, minLoad, maxLoad float64) {
 		minItems = 1
 	}
 	maxItems := int(float64(benchFileSize/itemSize) * maxLoad)
-	value := make([]byte, keySize)
+	value := make([]byte, defaultKeySize)
 	for i := 1; i < maxItems; i++ {
 		binary.LittleEndian.PutUint64(value, uint64(i))
-		h.Set(value, uint32(i), uint32(i)+3)
+		h.Set(value, uint32(i), uint64(i)+3)
 	}
 
 	start := time.Now()
@@ -133,15 +141,30 @@ func TestExtendedBenchHashDiskGetLoad(t *testing.T) {
 		t.Skip()
 	}
 	t.Run("Load_0-0.5", func(t *testing.T) {
-		benchmarkHashDiskGetWithLoad(t, 0, 0.5)
+		for _, probing := range []Probing{ProbingLinear, ProbingRobinHood} {
+			benchmarkHashDiskGetWithLoad(t, probing, 0, 0.5)
+		}
 	})
 	t.Run("Load_0.7-0.9", func(t *testing.T) {
-		benchmarkHashDiskGetWithLoad(t, 0.7, 0.9)
+		for _, probing := range []Probing{ProbingLinear, ProbingRobinHood} {
+			benchmarkHashDiskGetWithLoad(t, probing, 0.7, 0.9)
+		}
 	})
 	t.Run("Load_0.9-0.95", func(t *testing.T) {
-		benchmarkHashDiskGetWithLoad(t, 0.9, 0.95)
+		for _, probing := range []Probing{ProbingLinear, ProbingRobinHood} {
+			benchmarkHashDiskGetWithLoad(t, probing, 0.9, 0.95)
+		}
 	})
 	t.Run("Load_0.95-0.99", func(t *testing.T) {
-		benchmarkHashDiskGetWithLoad(t, 0.95, 0.99)
+		for _, probing := range []Probing{ProbingLinear, ProbingRobinHood} {
+			benchmarkHashDiskGetWithLoad(t, probing, 0.95, 0.99)
+		}
 	})
 }
+
+func probingName(probing Probing) string {
+	if probing == ProbingRobinHood {
+		return probingRobinHood
+	}
+	return probingLinear
+}
@@ -6,27 +6,36 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
 type testCase struct {
 	Key []byte
 	V1  uint32
-	V2  uint32
+	V2  uint64
 }
 
 func generateTestCase() testCase {
-	val := make([]byte, keySize)
+	val := make([]byte, defaultKeySize)
 	randbo.Read(val)
 	return testCase{
 		Key: val,
 		V1:  rand.Uint32(),
-		V2:  rand.Uint32(),
+		V2:  uint64(rand.Uint32()),
 	}
 }
 
+// testHashDiskConfig is the layout of the HashDisks of a default database with the given probing
+func testHashDiskConfig(probing Probing) hashDiskConfig {
+	return hashDiskConfig{KeySize: defaultKeySize, Probing: probing, Hasher: MurmurHasher{}}
+}
+
 func TestHashDiskWriteRead(t *testing.T) {
 	// Create DB
 	dir, err := ioutil.TempDir("", "hashdisk")
@@ -34,7 +43,7 @@ func TestHashDiskWriteRead(t *testing.T) {
 	defer os.RemoveAll(dir)
 	path := filepath.Join(dir, "test.hashdisk")
 
-	h, err := newHashDisk(path, testFileSize)
+	h, err := newHashDisk(path, testFileSize, 0, testHashDiskConfig(ProbingLinear))
 	require.NoError(t, err)
 	defer h.Close()
 
@@ -50,6 +59,40 @@ func TestHashDiskWriteRead(t *testing.T) {
 	}
 }
 
+func TestHashDiskLargeFiles(t *testing.T) {
+	// Test that offsets bigger than 4Gb are stored with large files, whatever the probing
+	for _, probing := range []Probing{ProbingLinear, ProbingRobinHood} {
+		dir, err := ioutil.TempDir("", "hashdisk")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "test.hashdisk")
+		config := testHashDiskConfig(probing)
+		config.LargeFiles = true
+
+		h, err := newHashDisk(path, testFileSize, 0, config)
+		require.NoError(t, err)
+		entrySize, _ := testHashDiskConfig(probing).layout()
+		require.Equal(t, entrySize+4, h.entrySize) // Offsets are 4 bytes bigger
+		tests := make([]testCase, 1000)
+		for i := range tests {
+			tests[i] = generateTestCase()
+			tests[i].V2 += 1 << 40
+			require.NoError(t, h.Set(tests[i].Key, tests[i].V1, tests[i].V2))
+		}
+		require.NoError(t, h.Close())
+
+		h, err = newHashDisk(path, testFileSize, 0, config)
+		require.NoError(t, err)
+		for _, test := range tests {
+			fileIndex, fileOffset, err := h.Get(test.Key)
+			require.NoError(t, err)
+			require.Equal(t, test.V1, fileIndex)
+			require.Equal(t, test.V2, fileOffset)
+		}
+		require.NoError(t, h.Close())
+	}
+}
+
 func TestHashDiskCloseOpen(t *testing.T) {
 	// Test that we correctly recover file after reopening
 	testCases := 100
@@ -60,7 +103,7 @@ func TestHashDiskCloseOpen(t *testing.T) {
 	defer os.RemoveAll(dir)
 	path := filepath.Join(dir, "test.hashdisk")
 
-	h, err := newHashDisk(path, testFileSize)
+	h, err := newHashDisk(path, testFileSize, 0, testHashDiskConfig(ProbingLinear))
 	require.NoError(t, err)
 
 	tests := make([]testCase, testCases)
@@ -71,13 +114,19 @@ func TestHashDiskCloseOpen(t *testing.T) {
 		require.NoError(t, err)
 	}
 
+	load := h.Load()
+
 	// Close and reopen
 	err = h.Close()
 	require.NoError(t, err)
-	h, err = newHashDisk(path, testFileSize)
+	h, err = newHashDisk(path, testFileSize, 0, testHashDiskConfig(ProbingLinear))
 	require.NoError(t, err)
 	defer h.Close()
 
+	// We recover the number of entries (and the load)
+	require.Equal(t, uint32(testCases), h.totalEntries)
+	require.Equal(t, load, h.Load())
+
 	for _, test := range tests {
 		returnedA, returnedB, err := h.Get(test.Key)
 		require.NoError(t, err)
@@ -93,7 +142,7 @@ func TestHashDiskLoad(t *testing.T) {
 	defer os.RemoveAll(dir)
 	path := filepath.Join(dir, "test.hashdisk")
 
-	h, err := newHashDisk(path, testFileSize)
+	h, err := newHashDisk(path, testFileSize, 0, testHashDiskConfig(ProbingLinear))
 	require.NoError(t, err)
 	defer h.Close()
 
@@ -115,6 +164,301 @@ func TestHashDiskLoad(t *testing.T) {
 	require.True(t, h.Load() < 0.1)
 }
 
+func TestHashDiskNoSpaceAfterReopen(t *testing.T) {
+	// Test that a full hashDisk stays full after reopening
+	dir, err := ioutil.TempDir("", "hashdisk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.hashdisk")
+
+	size := int64(100 * (defaultKeySize + 8))
+	h, err := newHashDisk(path, size, 0, testHashDiskConfig(ProbingLinear))
+	require.NoError(t, err)
+	for i := uint32(0); i < h.MaxSize; i++ {
+		err = h.Set(generateTestCase().Key, i, uint64(i))
+		require.NoError(t, err)
+	}
+	err = h.Set(generateTestCase().Key, 0, 0)
+	require.Equal(t, ErrNoSpace, err)
+	err = h.Close()
+	require.NoError(t, err)
+
+	h, err = newHashDisk(path, size, 0, testHashDiskConfig(ProbingLinear))
+	require.NoError(t, err)
+	defer h.Close()
+	require.InDelta(t, 1, h.Load(), 0.001)
+	err = h.Set(generateTestCase().Key, 0, 0)
+	require.Equal(t, ErrNoSpace, err)
+}
+
+func TestHashDiskBloomRebuild(t *testing.T) {
+	// Test that a bloom filter that was not closed properly is rebuilt
+	dir, err := ioutil.TempDir("", "hashdisk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.hashdisk")
+
+	h, err := newHashDisk(path, testFileSize, 0, testHashDiskConfig(ProbingLinear))
+	require.NoError(t, err)
+	tests := make([]testCase, 1000)
+	for i := range tests {
+		tests[i] = generateTestCase()
+		err = h.Set(tests[i].Key, tests[i].V1, tests[i].V2)
+		require.NoError(t, err)
+	}
+	// Lose the content of the filter, as if we crashed before it was written back
+	for i := range h.bloom.m[bloomHeaderSize:] {
+		h.bloom.m[bloomHeaderSize+i] = 0
+	}
+	h.bloom.dirty = 0 // Close won't mark it clean
+	err = h.Close()
+	require.NoError(t, err)
+
+	h, err = newHashDisk(path, testFileSize, 0, testHashDiskConfig(ProbingLinear))
+	require.NoError(t, err)
+	defer h.Close()
+	for _, test := range tests {
+		returnedA, returnedB, err := h.Get(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.V1, returnedA)
+		require.Equal(t, test.V2, returnedB)
+	}
+}
+
+func TestHashDiskRobinHood(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashdisk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.hashdisk")
+
+	size := int64(100000 * (defaultKeySize + 12))
+	h, err := newHashDisk(path, size, 0, testHashDiskConfig(ProbingRobinHood))
+	require.NoError(t, err)
+	require.Equal(t, uint32(100000), h.Slots())
+	require.Equal(t, uint32(95000), h.MaxSize)
+
+	// Fill it up to the max load
+	tests := make([]testCase, h.MaxSize)
+	for i := range tests {
+		tests[i] = generateTestCase()
+		err = h.Set(tests[i].Key, tests[i].V1, tests[i].V2)
+		require.NoError(t, err)
+	}
+	err = h.Set(generateTestCase().Key, 0, 0)
+	require.Equal(t, ErrNoSpace, err)
+	h.MaxSize++ // Overriding a key never needs space
+	err = h.Set(tests[0].Key, 1, 2)
+	require.NoError(t, err)
+	tests[0].V1, tests[0].V2 = 1, 2
+	h.MaxSize--
+
+	// Probe distances stay small and are consistent with the hash of the keys
+	var maxDistance uint32
+	for slot := uint32(0); slot < h.Slots(); slot++ {
+		key, _, _, ok := h.Entry(slot)
+		if !ok {
+			continue
+		}
+		offset := slot * h.entrySize
+		distance := encoding.Uint32(h.m[offset+h.keySize+8 : offset+h.entrySize])
+		require.Equal(t, slot, (h.slot(key)+distance)%h.entries)
+		if distance > maxDistance {
+			maxDistance = distance
+		}
+	}
+	require.True(t, maxDistance < 200, "max probe distance is %d", maxDistance)
+
+	err = h.Close()
+	require.NoError(t, err)
+	h, err = newHashDisk(path, size, 0, testHashDiskConfig(ProbingRobinHood))
+	require.NoError(t, err)
+	defer h.Close()
+	require.Equal(t, uint32(len(tests)), h.Len())
+	for _, test := range tests {
+		returnedA, returnedB, err := h.Get(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.V1, returnedA)
+		require.Equal(t, test.V2, returnedB)
+	}
+	for i := 0; i < 1000; i++ {
+		_, _, err := h.Get(generateTestCase().Key)
+		require.Equal(t, ErrKeyNotFound, err)
+	}
+}
+
+func TestHashDiskConcurrent(t *testing.T) {
+	// Run with -race: writers and readers of the same hashDisk don't wait for each other
+	configs := map[string]hashDiskConfig{
+		"linear":         testHashDiskConfig(ProbingLinear),
+		"robinhood":      testHashDiskConfig(ProbingRobinHood),
+		"linear_odd_key": {KeySize: 13, Probing: ProbingLinear, Hasher: MurmurHasher{}},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "hashdisk")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "test.hashdisk")
+
+			h, err := newHashDisk(path, int64(100000*(config.KeySize+12)), 0, config)
+			require.NoError(t, err)
+			defer h.Close()
+			require.Equal(t, name == "linear", h.concurrent)
+
+			writers, keysPerWriter := 8, 2000
+			keys := make([][]byte, writers*keysPerWriter)
+			for i := range keys {
+				keys[i] = make([]byte, config.KeySize)
+				randbo.Read(keys[i])
+			}
+			var wg sync.WaitGroup
+			errs := make(chan error, 2*writers)
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := w * keysPerWriter; i < (w+1)*keysPerWriter; i++ {
+						// Every writer also writes the keys of the first one
+						err := h.Set(keys[i], uint32(i), uint64(i)+3)
+						if err == nil {
+							err = h.Set(keys[i%keysPerWriter], uint32(i%keysPerWriter), uint64(i%keysPerWriter)+3)
+						}
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(w)
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					// A key is either not there yet or completely there
+					for i := 0; i < len(keys); i++ {
+						fileIndex, fileOffset, err := h.Get(keys[(i+w*keysPerWriter)%len(keys)])
+						if err == ErrKeyNotFound {
+							continue
+						}
+						if err == nil && uint64(fileIndex)+3 != fileOffset {
+							err = errors.Errorf("partly written location (%d, %d)", fileIndex, fileOffset)
+						}
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, uint32(len(keys)), h.Len())
+			for i, key := range keys {
+				fileIndex, fileOffset, err := h.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, uint32(i), fileIndex)
+				require.Equal(t, uint64(i)+3, fileOffset)
+			}
+			found := 0
+			for slot := uint32(0); slot < h.Slots(); slot++ {
+				if _, _, _, ok := h.Entry(slot); ok {
+					found++
+				}
+			}
+			require.Equal(t, len(keys), found)
+		})
+	}
+}
+
+func TestHashDiskPartlyPublished(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashdisk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	h, err := newHashDisk(filepath.Join(dir, "test.hashdisk"), testFileSize, 0, testHashDiskConfig(ProbingLinear))
+	require.NoError(t, err)
+	defer h.Close()
+
+	// other is the key being published with only its first word written: it looks like key
+	key := make([]byte, defaultKeySize)
+	key[0] = 1
+	other := append([]byte(nil), key...)
+	other[defaultKeySize-1] = 1
+	slot := h.slot(key)
+	require.NoError(t, h.bloom.Add(key)) // As if it was a false positive of the Bloom filter
+	offset := h.offset(slot)
+	h.stripe(slot).Lock()
+	atomicStoreUint32(h.m, offset+uint64(h.keySize), 7)
+	atomicStoreUint32(h.m, offset+uint64(h.keySize)+4, 9)
+	atomic.StoreUint32(wordAt(h.m, offset), nativeEndian.Uint32(other[0:4]))
+
+	done := make(chan error)
+	go func() {
+		_, _, err := h.Get(key)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Get returned before the key was published: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for i := uint64(4); i < uint64(h.keySize); i += 4 {
+		atomic.StoreUint32(wordAt(h.m, offset+i), nativeEndian.Uint32(other[i:i+4]))
+	}
+	h.stripe(slot).Unlock()
+	require.Equal(t, ErrKeyNotFound, <-done)
+
+	published, fileIndex, fileOffset, ok := h.Entry(slot)
+	require.True(t, ok)
+	require.Equal(t, other, published)
+	require.Equal(t, uint32(7), fileIndex)
+	require.Equal(t, uint64(9), fileOffset)
+}
+
+func TestHashDiskScanSlots(t *testing.T) {
+	configs := map[string]hashDiskConfig{
+		"linear":    testHashDiskConfig(ProbingLinear),
+		"robinhood": testHashDiskConfig(ProbingRobinHood),
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "hashdisk")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			entrySize, _ := config.layout()
+			h, err := newHashDisk(filepath.Join(dir, "test.hashdisk"), int64(10000*entrySize), 0, config)
+			require.NoError(t, err)
+			defer h.Close()
+
+			before := make(map[string]bool)
+			for len(before) < 5000 {
+				test := generateTestCase()
+				require.NoError(t, h.Set(test.Key, test.V1, test.V2))
+				before[string(test.Key)] = true
+			}
+			// Keys written between the batches move the entries that are already there (with Robin Hood probing)
+			seen := make(map[string]int)
+			for slot := uint32(0); slot < h.Slots(); slot += 64 {
+				end := slot + 64
+				if end > h.Slots() {
+					end = h.Slots()
+				}
+				h.ScanSlots(slot, end, func(key []byte, fileIndex uint32, fileOffset uint64) {
+					seen[string(key)]++
+				})
+				for i := 0; i < 10; i++ {
+					test := generateTestCase()
+					require.NoError(t, h.Set(test.Key, test.V1, test.V2))
+				}
+			}
+			for key := range before {
+				require.Equal(t, 1, seen[key])
+			}
+		})
+	}
+}
+
 func BenchmarkHashDiskWrite(b *testing.B) {
 	// Create DB
 	dir, err := ioutil.TempDir("", "hashdisk")
@@ -122,24 +466,52 @@ func BenchmarkHashDiskWrite(b *testing.B) {
 	defer os.RemoveAll(dir)
 	path := filepath.Join(dir, "test.hashdisk")
 
-	h, err := newHashDisk(path, benchFileSize)
+	h, err := newHashDisk(path, benchFileSize, 0, testHashDiskConfig(ProbingLinear))
 	if err != nil {
 		b.Fatalf("couldn't create the DB: %s", err)
 	}
 	defer h.Close()
 
 	items := int(h.MaxSize - 1) // So we can make sure we never create a new file on benchmark
-	b.SetBytes(keySize + 8)
+	b.SetBytes(defaultKeySize + 8)
 	b.ResetTimer()
-	value := make([]byte, keySize)
+	value := make([]byte, defaultKeySize)
 	for i := 0; i < b.N; i++ {
 		j := i % items
 		binary.LittleEndian.PutUint64(value, uint64(j))
-		h.Set(value, uint32(j), uint32(j)+3)
+		h.Set(value, uint32(j), uint64(j)+3)
 	}
 	b.StopTimer()
 }
 
+func BenchmarkHashDiskWriteParallel(b *testing.B) {
+	// Create DB
+	dir, err := ioutil.TempDir("", "hashdisk")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.hashdisk")
+
+	h, err := newHashDisk(path, benchFileSize, 0, testHashDiskConfig(ProbingLinear))
+	if err != nil {
+		b.Fatalf("couldn't create the DB: %s", err)
+	}
+	defer h.Close()
+
+	items := uint64(h.MaxSize - 1) // So we can make sure we never create a new file on benchmark
+	var next uint64
+	b.SetBytes(defaultKeySize + 8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		value := make([]byte, defaultKeySize)
+		for pb.Next() {
+			j := atomic.AddUint64(&next, 1) % items
+			binary.LittleEndian.PutUint64(value, j+1)
+			h.Set(value, uint32(j), uint64(j)+3)
+		}
+	})
+	b.StopTimer()
+}
+
 func BenchmarkHashDiskRead(b *testing.B) {
 	// Create DB
 	dir, err := ioutil.TempDir("", "hashdisk")
@@ -147,16 +519,16 @@ func BenchmarkHashDiskRead(b *testing.B) {
 	defer os.RemoveAll(dir)
 	path := filepath.Join(dir, "test.hashdisk")
 
-	h, err := newHashDisk(path, benchFileSize)
+	h, err := newHashDisk(path, benchFileSize, 0, testHashDiskConfig(ProbingLinear))
 	if err != nil {
 		b.Fatalf("couldn't create the DB: %s", err)
 	}
 	defer h.Close()
 
 	items := int(h.MaxSize - 1) // So we can make sure we never create a new file on benchmark
-	b.SetBytes(keySize + 8)
+	b.SetBytes(defaultKeySize + 8)
 	b.ResetTimer()
-	value := make([]byte, keySize)
+	value := make([]byte, defaultKeySize)
 	for i := 1; i < b.N; i++ {
 		j := i % items
 		binary.LittleEndian.PutUint64(value, uint64(j))
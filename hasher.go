@@ -0,0 +1,72 @@
+package kvimd
+
+import (
+	"encoding/binary"
+
+	"github.com/DataDog/hyperloglog"
+	"github.com/zeebo/xxh3"
+)
+
+// Hasher computes the hash of the keys, used to find their slot in the HashDisks.
+// Its name is persisted in the database manifest: a database can only be reopened with the hasher it was created with
+type Hasher interface {
+	// Name identifies the hash function, it must never change (or the database can't be read anymore)
+	Name() string
+	// Hash returns the hash of key. It must be thread-safe
+	Hash(key []byte) uint64
+}
+
+// MurmurHasher hashes keys with Murmur3 (32 bits). It is the default
+type MurmurHasher struct{}
+
+// Name of the hasher
+func (MurmurHasher) Name() string {
+	return hashFunctionMurmur
+}
+
+// Hash returns the Murmur3 hash of key
+func (MurmurHasher) Hash(key []byte) uint64 {
+	return uint64(hyperloglog.MurmurBytes(key))
+}
+
+// IdentityHasher uses the first 8 bytes of the keys (little endian) as their hash.
+// It is only suitable for keys that are already uniformly random (e.g: digests), hashing them would be wasted work
+type IdentityHasher struct{}
+
+// Name of the hasher
+func (IdentityHasher) Name() string {
+	return hashFunctionIdentity
+}
+
+// Hash returns the first 8 bytes of key (padded with zeros if key is shorter)
+func (IdentityHasher) Hash(key []byte) uint64 {
+	if len(key) >= 8 {
+		return binary.LittleEndian.Uint64(key)
+	}
+	var prefix [8]byte
+	copy(prefix[:], key)
+	return binary.LittleEndian.Uint64(prefix[:])
+}
+
+// XXH3Hasher hashes keys with XXH3 (64 bits). It is stronger than Murmur3 (32 bits)
+type XXH3Hasher struct{}
+
+// Name of the hasher
+func (XXH3Hasher) Name() string {
+	return hashFunctionXXH3
+}
+
+// Hash returns the XXH3 hash of key
+func (XXH3Hasher) Hash(key []byte) uint64 {
+	return xxh3.Hash(key)
+}
+
+// builtinHasher returns the hasher named name if it is one of the hashers of the package, otherwise nil
+func builtinHasher(name string) Hasher {
+	for _, h := range []Hasher{MurmurHasher{}, IdentityHasher{}, XXH3Hasher{}} {
+		if h.Name() == name {
+			return h
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package kvimd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestXXH3Hasher(t *testing.T) {
+	// Test vectors of the reference implementation (XXH3_64bits of the first n bytes of i*7+3)
+	tests := []struct {
+		length int
+		hash   uint64
+	}{
+		{0, 0x2d06800538d394c2},
+		{3, 0xa9088dda485b481c},
+		{16, 0xb8c859b0f030b585},
+		{128, 0x67425a03650261bf},
+		{240, 0x64556dc6b462a6cf},
+		{1024, 0x9b81661c641c72b1},
+	}
+	for _, test := range tests {
+		input := make([]byte, test.length)
+		for i := range input {
+			input[i] = byte(i*7 + 3)
+		}
+		require.Equal(t, test.hash, XXH3Hasher{}.Hash(input), test.length)
+	}
+}
+
+func TestIdentityHasher(t *testing.T) {
+	require.Equal(t, uint64(0x0807060504030201), IdentityHasher{}.Hash([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}))
+	require.Equal(t, uint64(0x030201), IdentityHasher{}.Hash([]byte{1, 2, 3}))
+}
+
+func TestBuiltinHasher(t *testing.T) {
+	for _, h := range []Hasher{MurmurHasher{}, IdentityHasher{}, XXH3Hasher{}} {
+		require.Equal(t, h, builtinHasher(h.Name()))
+	}
+	require.Nil(t, builtinHasher("unknown"))
+}
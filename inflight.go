@@ -0,0 +1,67 @@
+package kvimd
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// inflight is the table of the keys that are being written. A writer holds the lock of a key from the moment
+// it checks the key is not in the database to the moment it is inserted in a HashDisk, so that concurrent writers
+// of the same key wait for the first one and then find the key instead of storing the value again.
+// It is thread-safe
+type inflight struct {
+	mutex sync.Mutex
+	keys  map[string]*inflightKey
+}
+
+// inflightKey is the lock of a key, shared by all the writers of that key
+type inflightKey struct {
+	mutex   sync.Mutex
+	writers int // Number of writers holding or waiting for mutex, protected by inflight.mutex
+}
+
+func newInflight() *inflight {
+	return &inflight{keys: make(map[string]*inflightKey)}
+}
+
+// lock waits until no other writer holds key and holds it
+func (f *inflight) lock(key []byte) {
+	f.mutex.Lock()
+	k, ok := f.keys[string(key)]
+	if !ok {
+		k = &inflightKey{}
+		f.keys[string(key)] = k
+	}
+	k.writers++
+	f.mutex.Unlock()
+	k.mutex.Lock()
+}
+
+// unlock releases key, previously held with lock
+func (f *inflight) unlock(key []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	k := f.keys[string(key)]
+	k.writers--
+	if k.writers == 0 {
+		delete(f.keys, string(key))
+	}
+	k.mutex.Unlock()
+}
+
+// lockMany holds all the keys, which must be unique. They are locked in order so that two writers
+// of overlapping sets of keys can't deadlock. keys is sorted in place
+func (f *inflight) lockMany(keys [][]byte) {
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	for _, key := range keys {
+		f.lock(key)
+	}
+}
+
+// unlockMany releases all the keys, previously held with lockMany
+func (f *inflight) unlockMany(keys [][]byte) {
+	for _, key := range keys {
+		f.unlock(key)
+	}
+}
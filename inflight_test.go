@@ -0,0 +1,38 @@
+package kvimd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflight(t *testing.T) {
+	f := newInflight()
+	f.lock([]byte("a"))
+
+	locked := make(chan struct{})
+	go func() {
+		f.lockMany([][]byte{[]byte("b"), []byte("a")})
+		close(locked)
+	}()
+
+	// A writer of the same key waits for the first one
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-locked:
+		t.Fatal("lockMany returned while a key was held")
+	default:
+	}
+	f.lock([]byte("c")) // Other keys are not held
+	f.unlock([]byte("c"))
+
+	f.unlock([]byte("a"))
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("lockMany didn't return once the key was released")
+	}
+	f.unlockMany([][]byte{[]byte("a"), []byte("b")})
+	require.Empty(t, f.keys)
+}
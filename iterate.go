@@ -0,0 +1,105 @@
+package kvimd
+
+// iterateBatchSize is how many slots of a HashDisk are scanned per lock acquisition while iterating
+const iterateBatchSize = 4096
+
+// iterateEntry is a key (copied out of the HashDisk) and the location of its value
+type iterateEntry struct {
+	key        []byte
+	fileIndex  uint32
+	fileOffset uint64
+}
+
+// Iterate calls fn on every key and its value of the database, in no particular order. If fn returns an error,
+// the iteration stops and the error is returned.
+// key and value are read directly from the mmapped files: they must not be modified and are only valid until fn returns.
+// It is safe to call it concurrently with writes: every key written before Iterate was called is visited exactly once,
+// keys written during the iteration may or may not be visited. Close waits for Iterate to return.
+func (d *DB) Iterate(fn func(key, value []byte) error) error {
+	return d.iterate(false, fn)
+}
+
+// IterateKeys is like Iterate but only visits the keys, their values are not read
+func (d *DB) IterateKeys(fn func(key []byte) error) error {
+	return d.iterate(true, func(key, _ []byte) error {
+		return fn(key)
+	})
+}
+
+func (d *DB) iterate(keysOnly bool, fn func(key, value []byte) error) error {
+	if !d.leases.acquire() {
+		return ErrDBClosed
+	}
+	var readErr error
+	defer func() { d.corrupted(readErr) }() // Once the lease is released
+	defer d.leases.release()
+
+	// HashDisks are only closed after all leases are released so we can keep using them without the lock.
+	// If a new one is added while we iterate, it only contains keys written after we started
+	d.openHashDiskMutex.RLock()
+	hashDisks := append([]*hashDisk(nil), d.openHashDisk...)
+	d.openHashDiskMutex.RUnlock()
+	if len(hashDisks) == 0 {
+		return ErrDBClosed
+	}
+
+	var entries []iterateEntry
+	var keys []byte
+	for i, hd := range hashDisks {
+		for slot := uint32(0); slot < hd.Slots(); slot = batchEnd(hd, slot) {
+			// Copy a batch of entries so that we don't hold the lock while calling fn
+			entries, keys = entries[:0], keys[:0]
+			hd.ScanSlots(slot, batchEnd(hd, slot), func(key []byte, fileIndex uint32, fileOffset uint64) {
+				keys = append(keys, key...)
+				entries = append(entries, iterateEntry{
+					fileIndex:  fileIndex,
+					fileOffset: fileOffset,
+				})
+			})
+			for j := range entries {
+				entries[j].key = keys[j*d.keySize : (j+1)*d.keySize]
+			}
+
+			for _, e := range entries {
+				shadowed, err := isShadowed(hashDisks[i+1:], e.key)
+				if err != nil {
+					return err
+				}
+				if shadowed {
+					continue // It will be visited with the newer HashDisk
+				}
+				var value []byte
+				if !keysOnly {
+					if value, readErr = d.record(e.fileIndex, e.fileOffset); readErr != nil {
+						return readErr
+					}
+				}
+				if err := fn(e.key, value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// batchEnd returns the end of the batch of slots of h starting at start (see hashDisk.ScanSlots)
+func batchEnd(h *hashDisk, start uint32) uint32 {
+	if h.Slots()-start <= iterateBatchSize {
+		return h.Slots()
+	}
+	return start + iterateBatchSize
+}
+
+// isShadowed returns whether key is also in one of hashDisks
+func isShadowed(hashDisks []*hashDisk, key []byte) (bool, error) {
+	for _, hd := range hashDisks {
+		_, _, err := hd.Get(key)
+		if err == nil {
+			return true, nil
+		} else if err != ErrKeyNotFound {
+			return false, err
+		}
+	}
+	return false, nil
+}
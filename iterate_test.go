@@ -0,0 +1,128 @@
+package kvimd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Small files so that the keys are spread over multiple HashDisks
+	db, err := NewDB(dir, Options{FileSize: 1 << 20})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	tests := make(map[string][]byte)
+	keys := make([][]byte, 0, 40000)
+	values := make([][]byte, 0, 40000)
+	for i := 0; i < 40000; i++ {
+		test := generateKvimdTest()
+		tests[string(test.Key)] = test.Value
+		keys, values = append(keys, test.Key), append(values, test.Value)
+	}
+	_, err = db.WriteBatch(keys, values)
+	require.NoError(t, err)
+	require.True(t, len(db.manifest.HashDisks) > 1)
+
+	// Shadow a key of the oldest HashDisk in the newest one
+	key, fileIndex, fileOffset, ok := db.openHashDisk[0].Entry(findOccupiedSlot(db.openHashDisk[0]))
+	require.True(t, ok)
+	require.NoError(t, db.writeKey(append([]byte(nil), key...), fileIndex, fileOffset))
+
+	seen := make(map[string]bool)
+	err = db.Iterate(func(key, value []byte) error {
+		require.False(t, seen[string(key)], "key visited twice")
+		seen[string(key)] = true
+		expected, ok := tests[string(key)]
+		require.True(t, ok)
+		require.Equal(t, expected, value)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, seen, len(tests))
+
+	seen = make(map[string]bool)
+	err = db.IterateKeys(func(key []byte) error {
+		require.False(t, seen[string(key)], "key visited twice")
+		seen[string(key)] = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, seen, len(tests))
+
+	// Errors stop the iteration
+	stop := errors.New("stop")
+	count := 0
+	err = db.IterateKeys(func(key []byte) error {
+		count++
+		return stop
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, 1, count)
+}
+
+func TestIterateConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: 1 << 20})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	before := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		test := generateKvimdTest()
+		require.NoError(t, db.Write(test.Key, test.Value))
+		before[string(test.Key)] = true
+	}
+
+	// Generated beforehand, randbo is not safe for concurrent use
+	during := make([]kvimdTestCase, 20000)
+	for i := range during {
+		during[i] = generateKvimdTest()
+	}
+	errs := make(chan error, 1)
+	go func() {
+		for _, test := range during {
+			if err := db.Write(test.Key, test.Value); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	// Every key written before we started is visited exactly once
+	seen := make(map[string]bool)
+	err = db.IterateKeys(func(key []byte) error {
+		require.False(t, seen[string(key)], "key visited twice")
+		seen[string(key)] = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-errs)
+	for key := range before {
+		require.True(t, seen[key])
+	}
+}
+
+func findOccupiedSlot(h *hashDisk) uint32 {
+	for slot := uint32(0); slot < h.Slots(); slot++ {
+		if _, _, _, ok := h.Entry(slot); ok {
+			return slot
+		}
+	}
+	return 0
+}
@@ -1,9 +1,13 @@
 package kvimd
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,8 +15,6 @@ import (
 	"github.com/pkg/errors"
 )
 
-const keySize = 16 // Maybe change it to DB scoped after to have it configurable
-
 const (
 	rotateHashDiskMaxLoad   = 0.7  // Load factor at which point rotate will create a new HashDisk
 	rotateValuesDiskMaxLoad = 0.85 // % of file usage at which point rotate will create a new ValuesDisk
@@ -20,20 +22,87 @@ const (
 
 // Define public errors
 var (
-	ErrDBClosed    = errors.New("database is already closed")
-	ErrFileTooBig  = errors.New("file size is too big (max 4Gb)")
-	ErrInvalidKey  = errors.New("key is not valid")
-	ErrKeyNotFound = errors.New("key was not found in database")
-	ErrNoSpace     = errors.New("no space left in database") // What you usually want to do here is create a new file
-	ErrCorrupted   = errors.New("database seems corrupted")
+	ErrDBClosed     = errors.New("database is already closed")
+	ErrFileTooBig   = errors.New("file size is too big (max Options.MaxFileSize, 4Gb without Options.LargeFiles)")
+	ErrValueTooBig  = errors.New("value size is too big (max 4Gb)")
+	ErrInvalidKey   = errors.New("key is not valid")
+	ErrKeyNotFound  = errors.New("key was not found in database")
+	ErrNoSpace      = errors.New("no space left in database") // What you usually want to do here is create a new file
+	ErrCorrupted    = errors.New("database seems corrupted")
+	ErrKeySize      = errors.New("key size doesn't match the one the database was created with")
+	ErrManifest     = errors.New("database files don't match the manifest")
+	ErrIncompatible = errors.New("database format is not supported")
+	// ErrDanglingReference is returned when a key points to a ValuesDisk that is not part of the database
+	// (e.g: it was removed or renumbered by hand)
+	ErrDanglingReference = errors.New("key references a ValuesDisk that is not part of the database")
 )
 
+// CorruptedError is returned when a value read from disk doesn't match its checksum.
+// Since values are immutable, the caller can usually refetch it from its source.
+// errors.Cause returns ErrCorrupted for it
+type CorruptedError struct {
+	FileIndex  uint32 // Index of the ValuesDisk file (db#.valuesdisk)
+	FileOffset uint64 // Offset of the value in that file
+}
+
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("%s: invalid value in %s at offset %d", ErrCorrupted, createValuesDiskPath(e.FileIndex), e.FileOffset)
+}
+
+// Cause returns ErrCorrupted
+func (e *CorruptedError) Cause() error {
+	return ErrCorrupted
+}
+
+// Location is where the value of a key is stored
+type Location struct {
+	FileIndex  uint32 // Index of the ValuesDisk file (db#.valuesdisk)
+	FileOffset uint64 // Offset of the value in that file
+	Size       int    // Size of the value in bytes
+}
+
 // DB is a kvimd database.
-// It uses uint32 in a lot of places so this means: each hashmap file is max 4Gb; you can store max 4Gb*4Gb/workers values (a lot)
+// It uses uint32 in a lot of places so this means: each file is max 4Gb (unless it uses large files);
+// you can store max 4Gb*4Gb/workers values (a lot)
 type DB struct {
 	RootPath string
-	fileSize uint32
-	closed   uint32 // Just a boolean to indicate whether the database is closed. > 0 means it's closed
+	// Sizes of the new files (see nextFileSize)
+	hashDiskSize     int64
+	valuesDiskSize   int64
+	hashDiskGrowth   float64
+	valuesDiskGrowth float64
+	// Sizes the files never reach (see manifest.maxFileSize)
+	maxHashDiskSize   int64
+	maxValuesDiskSize int64
+	keySize           int
+	probing           Probing
+	hasher            Hasher
+	largeFiles        bool   // Offsets in ValuesDisks are uint64
+	closed            uint32 // Just a boolean to indicate whether the database is closed. > 0 means it's closed
+
+	durability Durability
+	logger     Logger
+	hooks      Hooks
+	// wal is nil if Options.WriteAheadLog is false
+	wal *writeAheadLog
+	// checkpointMutex needs a RLock from the moment a write is logged to the moment it is applied.
+	// A (write) Lock is taken to empty the log, making sure all the logged writes are in the files
+	checkpointMutex sync.RWMutex
+
+	// manifest is never modified in place: updateManifest saves a modified copy then swaps it
+	manifestMutex sync.Mutex
+	manifest      *manifest
+	// leases are held by readers using slices of the ValuesDisk mmaps directly (View), Close waits for them
+	leases *leases
+	// inflight holds the keys that are being written so that a value is only stored once per key
+	inflight *inflight
+	// rotateMutex makes sure only one rotation happens at a time
+	rotateMutex sync.Mutex
+	// compactMutex makes sure only one compaction happens at a time
+	compactMutex sync.Mutex
+	// sortedRuns caches the sorted runs of the HashDisks (see Scan), indexed by HashDisk index. They are built on demand
+	sortedRunsMutex sync.Mutex
+	sortedRuns      map[uint32]*sortedRun
 
 	// Current opened HashDisk DB. You should always write to the last one (openHashDisk[len-1])
 	// When looking up a value, you will need to look in each.
@@ -53,112 +122,117 @@ type DB struct {
 }
 
 // NewDB returns a new kvimd database
-func NewDB(root string, fileSize uint32) (*DB, error) {
-	if fileSize >= 2<<31-1 {
-		return nil, ErrFileTooBig
+func NewDB(root string, opts Options) (*DB, error) {
+	if opts.KeySize < 0 {
+		return nil, ErrKeySize
 	}
 
 	// Create paths if non-existant
 	if err := os.MkdirAll(root, 0755); err != nil {
 		return nil, err
 	}
-	// Load all HashDisk databases
-	files, err := listFiles(root, hashDiskPattern)
+	m, err := openManifest(root, opts)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to list directory")
+		return nil, err
 	}
-
-	openHashDisk := make([]*hashDisk, len(files))
-	closeAllOpenHashDisk := func() {
-		for _, h := range openHashDisk {
-			if h == nil {
-				// Done closing all
-				return
-			}
-			h.Close()
-		}
+	opts = opts.withDefaults() // The manifest already took care of the persisted options
+	probing, err := m.probing()
+	if err != nil {
+		return nil, err
 	}
-
-	for i, f := range files {
-		p := filepath.Join(root, f)
-		hd, err := newHashDisk(p, int64(fileSize))
-		if err != nil {
-			closeAllOpenHashDisk()
-			return nil, errors.Wrap(err, "failed to open HashDisk database")
-		}
-		openHashDisk[i] = hd
+	hasher, err := m.hasher(opts)
+	if err != nil {
+		return nil, err
 	}
-
-	// If there are none, create 1
-	if len(openHashDisk) == 0 {
-		p := filepath.Join(root, "db0.hashdisk")
-		hd, err := newHashDisk(p, int64(fileSize))
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to open HashDisk database")
-		}
-		openHashDisk = append(openHashDisk, hd)
+	largeFiles, err := m.largeFiles()
+	if err != nil {
+		return nil, err
 	}
 
-	// Load all ValuesDisk databases
-	files, err = listFiles(root, valuesDiskPattern)
+	// Values that were being streamed when we stopped can't be completed anymore
+	tmpFiles, err := listFiles(root, valueTmpPattern)
 	if err != nil {
-		closeAllOpenHashDisk()
 		return nil, errors.Wrap(err, "failed to list directory")
 	}
-
-	openValuesDisk := make(map[uint32]*valuesDisk)
-	closeAllOpenValuesDisk := func() {
-		for _, v := range openValuesDisk {
-			v.Close()
+	for _, f := range tmpFiles {
+		if err := os.Remove(filepath.Join(root, f)); err != nil {
+			return nil, errors.Wrap(err, "failed to remove temporary file")
 		}
 	}
 
-	maxValuesDiskIndex := uint32(0)
-	for i, f := range files {
-		// Try to find the highest index
-		index, err := getDBNumber(f)
+	db := &DB{
+		RootPath:         root,
+		hashDiskSize:     m.hashDiskSize(),
+		valuesDiskSize:   m.valuesDiskSize(),
+		hashDiskGrowth:   m.HashDiskGrowth,
+		valuesDiskGrowth: m.ValuesDiskGrowth,
+		keySize:          m.KeySize,
+		probing:          probing,
+		hasher:           hasher,
+		largeFiles:       largeFiles,
+		manifest:         m,
+
+		durability: opts.Durability,
+		logger:     opts.Logger,
+		hooks:      opts.Hooks,
+		leases:     newLeases(),
+		inflight:   newInflight(),
+
+		openValuesDisk: make(map[uint32]*valuesDisk),
+		sortedRuns:     make(map[uint32]*sortedRun),
+	}
+	db.maxHashDiskSize = m.maxFileSize(db.hashDiskConfig().maxFileSize())
+	db.maxValuesDiskSize = m.maxFileSize(math.MaxInt64)
+
+	// Load all HashDisk databases
+	for _, index := range m.HashDisks {
+		p := filepath.Join(root, createHashDiskPath(index))
+		hd, err := newHashDisk(p, db.hashDiskSize, index, db.hashDiskConfig())
 		if err != nil {
-			closeAllOpenHashDisk()
-			closeAllOpenValuesDisk()
-			return nil, err
+			db.Close()
+			return nil, errors.Wrap(err, "failed to open HashDisk database")
 		}
-		if uint32(index) > maxValuesDiskIndex {
-			maxValuesDiskIndex = uint32(index)
+		db.openHashDisk = append(db.openHashDisk, hd)
+	}
+	// If there are none, create 1
+	if len(db.openHashDisk) == 0 {
+		if _, err := db.addHashDisk(); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "failed to open HashDisk database")
 		}
+	}
 
-		p := filepath.Join(root, f)
-		vd, err := newValuesDisk(p, fileSize, uint32(index))
+	// Load all ValuesDisk databases, the last one is the one we write to
+	for _, index := range m.ValuesDisks {
+		p := filepath.Join(root, createValuesDiskPath(index))
+		vd, err := newValuesDisk(p, db.valuesDiskSize, index)
 		if err != nil {
-			closeAllOpenHashDisk()
-			closeAllOpenValuesDisk()
+			db.Close()
 			return nil, errors.Wrap(err, "failed to open ValuesDisk database")
 		}
-		openValuesDisk[uint32(i)] = vd
+		db.openValuesDisk[index] = vd
+		db.currentValuesDiskIndex = index
 	}
-
 	// If there are none, create 1
-	if len(openValuesDisk) == 0 {
-		p := filepath.Join(root, createValuesDiskPath(0))
-		vd, err := newValuesDisk(p, fileSize, 0)
-		if err != nil {
-			closeAllOpenHashDisk()
-			closeAllOpenValuesDisk()
+	if len(db.openValuesDisk) == 0 {
+		if _, err := db.addValuesDisk(); err != nil {
+			db.Close()
 			return nil, errors.Wrap(err, "failed to open ValuesDisk database")
 		}
-		openValuesDisk[0] = vd
+	}
+	// ValuesDisks are found by their index so there can be gaps, but every key must point to one that is there
+	if err := db.checkReferences(); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	db := &DB{
-		RootPath: root,
-		fileSize: fileSize,
-
-		openHashDisk:           openHashDisk,
-		openValuesDisk:         openValuesDisk,
-		currentValuesDiskIndex: maxValuesDiskIndex,
+	// Replay the writes that might not have made it to the files before a crash
+	if err := db.openWriteAheadLog(opts.WriteAheadLog); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to replay write-ahead log")
 	}
 
-	// Since currently valuesDisk does not allow writing to the same file on reload, we need to force
-	// at least one rotation to create a new file
+	// We keep appending to the last ValuesDisk, only create new files if the current ones are full
 	err = db.rotate()
 	if err != nil {
 		db.Close()
@@ -175,33 +249,120 @@ func NewDB(root string, fileSize uint32) (*DB, error) {
 				return
 			}
 			if err != nil {
-				fmt.Printf("kvimd: failed to create new databases: %s\n", err)
+				db.backgroundError(errors.Wrap(err, "failed to create new databases"))
+			}
+			if db.wal != nil && db.wal.Size() > walCheckpointSize {
+				if err := db.checkpoint(); err != nil {
+					db.backgroundError(errors.Wrap(err, "failed to checkpoint write-ahead log"))
+				}
 			}
 		}
 	}()
+	if opts.Durability == DurabilityPeriodic {
+		go func() {
+			ticker := time.NewTicker(opts.SyncInterval)
+			for range ticker.C {
+				err := db.Sync()
+				if atomic.LoadUint32(&db.closed) > 0 {
+					// We are closed, Close already flushed everything
+					return
+				}
+				if err != nil {
+					db.backgroundError(errors.Wrap(err, "failed to sync databases"))
+				}
+			}
+		}()
+	}
 	return db, nil
 }
 
+// valuesDiskLocked returns the ValuesDisk of index fileIndex, or ErrDanglingReference if it is not part of the database.
+// The caller must hold a read lock on openValuesDiskMutex
+func (d *DB) valuesDiskLocked(fileIndex uint32) (*valuesDisk, error) {
+	if len(d.openValuesDisk) == 0 {
+		return nil, ErrDBClosed
+	}
+	vd, ok := d.openValuesDisk[fileIndex]
+	if !ok {
+		return nil, errors.Wrapf(ErrDanglingReference, "%s is not part of the database", createValuesDiskPath(fileIndex))
+	}
+	return vd, nil
+}
+
+// record returns the value stored at fileOffset of fileIndex, directly from the mmap.
+// The caller holds a lease, it must call corrupted with the error once the lease is released
+func (d *DB) record(fileIndex uint32, fileOffset uint64) ([]byte, error) {
+	d.openValuesDiskMutex.RLock()
+	defer d.openValuesDiskMutex.RUnlock()
+	vd, err := d.valuesDiskLocked(fileIndex)
+	if err != nil {
+		return nil, err
+	}
+	return vd.record(fileOffset)
+}
+
+// corrupted calls the OnCorruption hook if err is a *CorruptedError and returns err.
+// The hook can call the database so it must not be called with a lock or a lease held
+func (d *DB) corrupted(err error) error {
+	if ce, ok := err.(*CorruptedError); ok {
+		d.hooks.corruption(ce)
+	}
+	return err
+}
+
+// backgroundError logs err, which was returned by a background task, and calls the OnBackgroundError hook
+func (d *DB) backgroundError(err error) {
+	d.logger.Errorf("%s", err)
+	d.hooks.backgroundError(err)
+}
+
+// checkReferences returns ErrDanglingReference if an entry of the HashDisks points to a ValuesDisk
+// that is not part of the database
+func (d *DB) checkReferences() error {
+	for _, hd := range d.openHashDisk {
+		for _, index := range hd.References() {
+			if _, ok := d.openValuesDisk[index]; !ok {
+				return errors.Wrapf(ErrDanglingReference, "%s references %s", createHashDiskPath(hd.FileIndex), createValuesDiskPath(index))
+			}
+		}
+	}
+	return nil
+}
+
+// KeySize returns the size of the keys of the database
+func (d *DB) KeySize() int {
+	return d.keySize
+}
+
+// hashDiskConfig returns the layout of all the HashDisks of the database
+func (d *DB) hashDiskConfig() hashDiskConfig {
+	return hashDiskConfig{KeySize: d.keySize, Probing: d.probing, Hasher: d.hasher, LargeFiles: d.largeFiles}
+}
+
 // findKey tries to find and return the value in HashDisk of the key
 // If the key is not found, return a ErrKeyNotFound error
-func (d *DB) findKey(key []byte) (fileIndex, fileOffset uint32, err error) {
+func (d *DB) findKey(key []byte) (fileIndex uint32, fileOffset uint64, err error) {
+	if len(key) != d.keySize {
+		return 0, 0, ErrInvalidKey
+	}
 	d.openHashDiskMutex.RLock()
+	defer d.openHashDiskMutex.RUnlock()
 	if len(d.openHashDisk) == 0 {
-		d.openHashDiskMutex.RUnlock()
 		return 0, 0, ErrDBClosed
 	}
+	return d.findKeyLocked(key)
+}
+
+// findKeyLocked is findKey when the caller already holds a read lock on openHashDiskMutex
+func (d *DB) findKeyLocked(key []byte) (fileIndex uint32, fileOffset uint64, err error) {
 	for i := len(d.openHashDisk) - 1; i >= 0; i-- {
-		db := d.openHashDisk[i]
-		index, offset, err := db.Get(key)
+		index, offset, err := d.openHashDisk[i].Get(key)
 		if err == nil { // The key is there
-			d.openHashDiskMutex.RUnlock()
 			return index, offset, nil
 		} else if err != ErrKeyNotFound {
-			d.openHashDiskMutex.RUnlock()
 			return 0, 0, err // Something wrong, return
 		}
 	}
-	d.openHashDiskMutex.RUnlock()
 	return 0, 0, ErrKeyNotFound
 }
 
@@ -213,20 +374,220 @@ func (d *DB) Read(key []byte) ([]byte, error) {
 		return nil, err
 	}
 	d.openValuesDiskMutex.RLock()
-	if len(d.openValuesDisk) == 0 {
+	vd, err := d.valuesDiskLocked(fileIndex)
+	if err != nil {
 		d.openValuesDiskMutex.RUnlock()
+		return nil, err
+	}
+	value, err := vd.Get(fileOffset)
+	d.openValuesDiskMutex.RUnlock()
+	return value, d.corrupted(err)
+}
+
+// View calls fn with the value of key, read directly from the mmapped file (no copy, no allocation).
+// value must not be modified and is only valid until fn returns: copy it if you need to keep it.
+// Close waits for all the running fn to return before unmapping the files, so fn should not block for long.
+// Return ErrKeyNotFound if key doesn't exist, otherwise the error returned by fn
+func (d *DB) View(key []byte, fn func(value []byte) error) error {
+	if !d.leases.acquire() {
+		return ErrDBClosed
+	}
+	var readErr error
+	defer func() { d.corrupted(readErr) }() // Once the lease is released
+	defer d.leases.release()
+	fileIndex, fileOffset, err := d.findKey(key)
+	if err != nil {
+		return err
+	}
+	value, readErr := d.record(fileIndex, fileOffset)
+	if readErr != nil {
+		return readErr
+	}
+	return fn(value)
+}
+
+// ValueReader streams a value directly from the mmapped file, without copying it in memory.
+// It implements io.Reader, io.ReaderAt and io.Seeker, Size returns the size of the value.
+// It holds a lease on the database so it must be closed once done: Close of the database waits for it
+type ValueReader struct {
+	*io.SectionReader
+	release sync.Once
+	leases  *leases
+}
+
+// Close releases the lease on the database. It is not safe to read from r after it
+func (r *ValueReader) Close() error {
+	r.release.Do(r.leases.release)
+	return nil
+}
+
+// Open returns a reader over the value of key (which checksum is verified beforehand), so that it can be
+// streamed (e.g: io.Copy) without allocating it entirely. The reader must be closed.
+// Return ErrKeyNotFound if key doesn't exist
+func (d *DB) Open(key []byte) (*ValueReader, error) {
+	if !d.leases.acquire() {
 		return nil, ErrDBClosed
 	}
-	value, err := d.openValuesDisk[fileIndex].Get(fileOffset)
+	fileIndex, fileOffset, err := d.findKey(key)
+	if err != nil {
+		d.leases.release()
+		return nil, err
+	}
+	value, err := d.record(fileIndex, fileOffset)
+	if err != nil {
+		d.leases.release()
+		return nil, d.corrupted(err)
+	}
+	return &ValueReader{
+		SectionReader: io.NewSectionReader(bytes.NewReader(value), 0, int64(len(value))),
+		leases:        d.leases,
+	}, nil
+}
+
+// Has returns whether key is in the database, without reading its value
+func (d *DB) Has(key []byte) (bool, error) {
+	_, _, err := d.findKey(key)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// HasMany is Has for multiple keys, locks are only taken once. Return ErrInvalidKey if any of the keys is invalid
+func (d *DB) HasMany(keys [][]byte) ([]bool, error) {
+	_, _, errs, err := d.findKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(keys))
+	for i, err := range errs {
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		found[i] = err == nil
+	}
+	return found, nil
+}
+
+// Locate returns where the value of key is stored and its size, without reading (nor copying) it
+// Return ErrKeyNotFound if key doesn't exist
+func (d *DB) Locate(key []byte) (Location, error) {
+	fileIndex, fileOffset, err := d.findKey(key)
+	if err != nil {
+		return Location{}, err
+	}
+	d.openValuesDiskMutex.RLock()
+	vd, err := d.valuesDiskLocked(fileIndex)
+	if err != nil {
+		d.openValuesDiskMutex.RUnlock()
+		return Location{}, err
+	}
+	size, err := vd.Size(fileOffset)
+	d.openValuesDiskMutex.RUnlock()
+	if err != nil {
+		return Location{}, d.corrupted(err)
+	}
+	return Location{FileIndex: fileIndex, FileOffset: fileOffset, Size: size}, nil
+}
+
+// ReadMany reads the values of multiple keys. It is the same as calling Read on each key but locks are only taken
+// once and values are read in the order they are stored on disk.
+// Return the values and the error of each key (ErrKeyNotFound if a key doesn't exist) or a non-nil error
+// if the whole read failed
+func (d *DB) ReadMany(keys [][]byte) ([][]byte, []error, error) {
+	fileIndexes, fileOffsets, errs, err := d.findKeys(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Read values grouped by file and in order of offset
+	order := make([]int, 0, len(keys))
+	for i := range keys {
+		if errs[i] == nil {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		if fileIndexes[i] != fileIndexes[j] {
+			return fileIndexes[i] < fileIndexes[j]
+		}
+		return fileOffsets[i] < fileOffsets[j]
+	})
+
+	values := make([][]byte, len(keys))
+	d.openValuesDiskMutex.RLock()
+	if len(d.openValuesDisk) == 0 {
+		d.openValuesDiskMutex.RUnlock()
+		return nil, nil, ErrDBClosed
+	}
+	for _, i := range order {
+		vd, err := d.valuesDiskLocked(fileIndexes[i])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		values[i], errs[i] = vd.Get(fileOffsets[i])
+	}
 	d.openValuesDiskMutex.RUnlock()
-	return value, err
+	for _, i := range order {
+		d.corrupted(errs[i])
+	}
+	return values, errs, nil
+}
+
+// findKeys is findKey for multiple keys. It takes the lock once and looks up all the keys in a HashDisk
+// before moving to the next one
+func (d *DB) findKeys(keys [][]byte) (fileIndexes []uint32, fileOffsets []uint64, errs []error, err error) {
+	fileIndexes = make([]uint32, len(keys))
+	fileOffsets = make([]uint64, len(keys))
+	errs = make([]error, len(keys))
+	remaining := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if len(key) != d.keySize {
+			errs[i] = ErrInvalidKey
+		} else {
+			errs[i] = ErrKeyNotFound
+			remaining = append(remaining, i)
+		}
+	}
+
+	d.openHashDiskMutex.RLock()
+	defer d.openHashDiskMutex.RUnlock()
+	if len(d.openHashDisk) == 0 {
+		return nil, nil, nil, ErrDBClosed
+	}
+	for h := len(d.openHashDisk) - 1; h >= 0 && len(remaining) > 0; h-- {
+		db := d.openHashDisk[h]
+		notFound := remaining[:0]
+		for _, i := range remaining {
+			fileIndexes[i], fileOffsets[i], errs[i] = db.Get(keys[i])
+			if errs[i] == ErrKeyNotFound {
+				notFound = append(notFound, i)
+			}
+		}
+		remaining = notFound
+	}
+	return fileIndexes, fileOffsets, errs, nil
 }
 
 // Write a value for a given key in the database. If write succeed, returned error is nil
-// Value might not be persisted directly to disk.
+// Depending on Options.Durability, value might not be persisted directly to disk (see Sync).
+// With Options.WriteAheadLog, the write is persisted in the log before Write returns.
 func (d *DB) Write(key, value []byte) error {
+	return d.write(key, value, d.wal != nil)
+}
+
+// write a value for a given key in the database, logging it in the write-ahead log first if log is true
+func (d *DB) write(key, value []byte, log bool) (err error) {
+	if uint64(len(value)) >= maxValueSize {
+		return ErrValueTooBig // Don't even log it
+	}
+	// Concurrent writers of key wait for us and then find it
+	d.inflight.lock(key)
+	defer d.inflight.unlock(key)
 	// Check if the key already exist first (we don't need to override in that case)
-	_, _, err := d.findKey(key)
+	_, _, err = d.findKey(key)
 	if err == nil {
 		return nil // We found the key already
 	}
@@ -234,72 +595,400 @@ func (d *DB) Write(key, value []byte) error {
 		return errors.Wrap(err, "failed to find key")
 	}
 
+	if log {
+		defer func() {
+			if err != nil {
+				d.discardFailedWrites() // Once we released checkpointMutex
+			}
+		}()
+		d.checkpointMutex.RLock()
+		defer d.checkpointMutex.RUnlock()
+		if err := d.wal.Append(key, value); err != nil {
+			return errors.Wrap(err, "failed to write to write-ahead log")
+		}
+	}
+
 	// Then write to valuesDisk DB
-	d.openValuesDiskMutex.RLock()
-	if len(d.openValuesDisk) == 0 {
-		d.openValuesDiskMutex.RUnlock()
-		return ErrDBClosed
+	index, offset, err := d.writeValue(value)
+	if err == ErrNoSpace {
+		// On failing because of space, force rotate & retry once
+		d.rotate()
+		index, offset, err = d.writeValue(value)
 	}
-	index := d.currentValuesDiskIndex
-	offset, err := d.openValuesDisk[index].Set(value)
-	d.openValuesDiskMutex.RUnlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to write to ValuesDisk")
+	}
+
+	// Then insert into hashDisk DB
+	err = d.writeKey(key, index, offset)
 	if err == ErrNoSpace {
 		// On failing because of space, force rotate & retry once
 		d.rotate()
-		d.openValuesDiskMutex.RLock()
-		if len(d.openValuesDisk) == 0 {
-			d.openValuesDiskMutex.RUnlock()
-			return ErrDBClosed
+		err = d.writeKey(key, index, offset)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write to HashDisk")
+	}
+	return nil
+}
+
+// writeFrom writes a value of size bytes read from r for a given key, r is read again if the write needs to be retried
+func (d *DB) writeFrom(key []byte, r io.ReadSeeker, size int) (err error) {
+	if uint64(size) >= maxValueSize {
+		return ErrValueTooBig // Don't even log it
+	}
+	d.inflight.lock(key)
+	defer d.inflight.unlock(key)
+	_, _, err = d.findKey(key)
+	if err == nil {
+		return nil // We found the key already
+	}
+	if err != ErrKeyNotFound && err != nil {
+		return errors.Wrap(err, "failed to find key")
+	}
+
+	if d.wal != nil {
+		defer func() {
+			if err != nil {
+				d.discardFailedWrites() // Once we released checkpointMutex
+			}
+		}()
+		d.checkpointMutex.RLock()
+		defer d.checkpointMutex.RUnlock()
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "failed to read value")
+		}
+		if err := d.wal.AppendFrom(key, r, size); err != nil {
+			return errors.Wrap(err, "failed to write to write-ahead log")
 		}
-		index = d.currentValuesDiskIndex
-		offset, err = d.openValuesDisk[index].Set(value)
+	}
+
+	index, offset, err := d.writeValueFrom(r, size)
+	if err == ErrNoSpace {
+		// On failing because of space, force rotate & retry once
+		d.rotate()
+		index, offset, err = d.writeValueFrom(r, size)
 	}
 	if err != nil {
 		return errors.Wrap(err, "failed to write to ValuesDisk")
 	}
 
-	// Then insert into hashDisk DB
+	err = d.writeKey(key, index, offset)
+	if err == ErrNoSpace {
+		// On failing because of space, force rotate & retry once
+		d.rotate()
+		err = d.writeKey(key, index, offset)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write to HashDisk")
+	}
+	return nil
+}
+
+// writeValue appends value to the current ValuesDisk and returns where it was written
+func (d *DB) writeValue(value []byte) (fileIndex uint32, fileOffset uint64, err error) {
+	d.openValuesDiskMutex.RLock()
+	defer d.openValuesDiskMutex.RUnlock()
+	if len(d.openValuesDisk) == 0 {
+		return 0, 0, ErrDBClosed
+	}
+	fileIndex = d.currentValuesDiskIndex
+	vd := d.openValuesDisk[fileIndex]
+	fileOffset, err = vd.Set(value)
+	if err == nil && d.durability == DurabilitySync {
+		err = vd.Sync()
+	}
+	return fileIndex, fileOffset, err
+}
+
+// writeValueFrom appends a value of size bytes read from the beginning of r to the current ValuesDisk
+func (d *DB) writeValueFrom(r io.ReadSeeker, size int) (fileIndex uint32, fileOffset uint64, err error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	d.openValuesDiskMutex.RLock()
+	defer d.openValuesDiskMutex.RUnlock()
+	if len(d.openValuesDisk) == 0 {
+		return 0, 0, ErrDBClosed
+	}
+	fileIndex = d.currentValuesDiskIndex
+	vd := d.openValuesDisk[fileIndex]
+	fileOffset, err = vd.SetFrom(r, size)
+	if err == nil && d.durability == DurabilitySync {
+		err = vd.Sync()
+	}
+	return fileIndex, fileOffset, err
+}
+
+// writeKey inserts the location of the value of key in the current HashDisk
+func (d *DB) writeKey(key []byte, fileIndex uint32, fileOffset uint64) error {
+	_, err := d.writeKeys([][]byte{key}, []uint32{fileIndex}, []uint64{fileOffset})
+	return err
+}
+
+// writeKeys inserts the locations of the values of keys in the current HashDisk
+// Return how many keys were inserted before an error happened
+func (d *DB) writeKeys(keys [][]byte, fileIndexes []uint32, fileOffsets []uint64) (int, error) {
 	d.openHashDiskMutex.RLock()
+	defer d.openHashDiskMutex.RUnlock()
 	if len(d.openHashDisk) == 0 {
-		d.openHashDiskMutex.RUnlock()
-		return ErrDBClosed
+		return 0, ErrDBClosed
 	}
 	dbHash := d.openHashDisk[len(d.openHashDisk)-1]
-	dbHash.Lock()
-	err = dbHash.Set(key, index, offset)
-	dbHash.Unlock()
+	var err error
+	n := 0
+	for ; n < len(keys); n++ {
+		if err = dbHash.Set(keys[n], fileIndexes[n], fileOffsets[n]); err != nil {
+			break
+		}
+	}
+	if n > 0 && d.durability == DurabilitySync {
+		err = firstError(err, dbHash.Sync())
+	}
+	return n, err
+}
+
+// WriteBatch writes multiple key / value pairs in the database. It is the same as calling Write on each pair
+// but locks are only taken once per batch and the space for all the values is reserved at once.
+// If a key is present multiple times in the batch, only its first value is written.
+// Return the error of each pair (nil if it was written) or a non-nil error if the whole batch failed.
+func (d *DB) WriteBatch(keys, values [][]byte) (errs []error, err error) {
+	if len(keys) != len(values) {
+		return nil, errors.Errorf("got %d keys but %d values", len(keys), len(values))
+	}
+	errs = make([]error, len(keys))
+
+	// Find which pairs we need to write
+	var candidates []int
+	var candidateKeys [][]byte
+	seen := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		if len(key) != d.keySize {
+			errs[i] = ErrInvalidKey
+			continue
+		}
+		if uint64(len(values[i])) >= maxValueSize {
+			errs[i] = ErrValueTooBig // Don't even log it
+			continue
+		}
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		candidates = append(candidates, i)
+		candidateKeys = append(candidateKeys, key)
+	}
+	// Concurrent writers of these keys wait for us and then find them
+	d.inflight.lockMany(candidateKeys)
+	defer d.inflight.unlockMany(candidateKeys)
+	var pending []int
+	d.openHashDiskMutex.RLock()
+	if len(d.openHashDisk) == 0 {
+		d.openHashDiskMutex.RUnlock()
+		return nil, ErrDBClosed
+	}
+	for _, i := range candidates {
+		_, _, err := d.findKeyLocked(keys[i])
+		if err == ErrKeyNotFound {
+			pending = append(pending, i)
+		} else if err != nil {
+			errs[i] = errors.Wrap(err, "failed to find key")
+		}
+	}
 	d.openHashDiskMutex.RUnlock()
+	if len(pending) == 0 {
+		return errs, nil
+	}
+	pendingKeys := make([][]byte, len(pending))
+	pendingValues := make([][]byte, len(pending))
+	for j, i := range pending {
+		pendingKeys[j] = keys[i]
+		pendingValues[j] = values[i]
+	}
+
+	// failed is whether a pair that was logged couldn't be written
+	failed := false
+	if d.wal != nil {
+		defer func() {
+			if err != nil || failed {
+				d.discardFailedWrites() // Once we released checkpointMutex
+			}
+		}()
+		d.checkpointMutex.RLock()
+		defer d.checkpointMutex.RUnlock()
+		if err := d.wal.AppendBatch(pendingKeys, pendingValues); err != nil {
+			return nil, errors.Wrap(err, "failed to write to write-ahead log")
+		}
+	}
+
+	// Then write to valuesDisk DB
+	fileIndexes, fileOffsets, err := d.writeValues(pendingValues)
 	if err == ErrNoSpace {
 		// On failing because of space, force rotate & retry once
 		d.rotate()
-		d.openHashDiskMutex.RLock()
-		if len(d.openHashDisk) == 0 {
-			d.openHashDiskMutex.RUnlock()
-			return ErrDBClosed
-		}
-		dbHash := d.openHashDisk[len(d.openHashDisk)-1]
-		dbHash.Lock()
-		err = dbHash.Set(key, index, offset)
-		dbHash.Unlock()
-		d.openHashDiskMutex.RUnlock()
+		fileIndexes, fileOffsets, err = d.writeValues(pendingValues)
+	}
+	if err == ErrNoSpace || err == ErrValueTooBig {
+		// The batch doesn't fit in a single file (or one of the values is too big), write the values one by one
+		fileIndexes = make([]uint32, len(pendingValues))
+		fileOffsets = make([]uint64, len(pendingValues))
+		var written []int
+		for j, value := range pendingValues {
+			index, offset, err := d.writeValue(value)
+			if err == ErrNoSpace {
+				d.rotate()
+				index, offset, err = d.writeValue(value)
+			}
+			if err != nil {
+				errs[pending[j]] = errors.Wrap(err, "failed to write to ValuesDisk")
+				failed = true
+				continue
+			}
+			fileIndexes[j], fileOffsets[j] = index, offset
+			written = append(written, j)
+		}
+		for k, j := range written {
+			pending[k], pendingKeys[k] = pending[j], pendingKeys[j]
+			fileIndexes[k], fileOffsets[k] = fileIndexes[j], fileOffsets[j]
+		}
+		pending, pendingKeys = pending[:len(written)], pendingKeys[:len(written)]
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to write to ValuesDisk")
+	}
+
+	// Then insert into hashDisk DB
+	retried := false
+	for len(pendingKeys) > 0 {
+		n, err := d.writeKeys(pendingKeys, fileIndexes, fileOffsets)
+		pending, pendingKeys = pending[n:], pendingKeys[n:]
+		fileIndexes, fileOffsets = fileIndexes[n:], fileOffsets[n:]
+		if err == ErrNoSpace && (n > 0 || !retried) {
+			// On failing because of space, force rotate & retry (only once if we couldn't insert anything)
+			d.rotate()
+			retried = n == 0
+			continue
+		}
+		if err != nil {
+			for _, i := range pending {
+				errs[i] = errors.Wrap(err, "failed to write to HashDisk")
+			}
+			failed = true
+			break
+		}
+	}
+	return errs, nil
+}
+
+// writeValues appends values to the current ValuesDisk, reserving the space for all of them at once
+func (d *DB) writeValues(values [][]byte) (fileIndexes []uint32, fileOffsets []uint64, err error) {
+	d.openValuesDiskMutex.RLock()
+	defer d.openValuesDiskMutex.RUnlock()
+	if len(d.openValuesDisk) == 0 {
+		return nil, nil, ErrDBClosed
+	}
+	fileIndex := d.currentValuesDiskIndex
+	vd := d.openValuesDisk[fileIndex]
+	fileOffsets, err = vd.SetBatch(values)
+	if err == nil && d.durability == DurabilitySync {
+		err = vd.Sync()
 	}
 	if err != nil {
-		return errors.Wrap(err, "failed to write to HashDisk")
+		return nil, nil, err
 	}
-	return nil
+	fileIndexes = make([]uint32, len(values))
+	for i := range fileIndexes {
+		fileIndexes[i] = fileIndex
+	}
+	return fileIndexes, fileOffsets, nil
+}
+
+// Sync flushes all the writes done so far to disk. Once it returns, they will survive a crash or a power failure
+// With Options.WriteAheadLog, it also empties the log
+func (d *DB) Sync() error {
+	return d.checkpoint()
+}
+
+// checkpoint flushes all the files to disk and empties the write-ahead log
+func (d *DB) checkpoint() error {
+	if d.wal == nil {
+		return d.syncFiles()
+	}
+	// Wait for all the logged writes to be applied
+	d.checkpointMutex.Lock()
+	defer d.checkpointMutex.Unlock()
+	if err := d.syncFiles(); err != nil {
+		return err
+	}
+	return d.wal.Truncate()
+}
+
+// discardFailedWrites empties the write-ahead log after a write that was logged failed, so that it is not replayed on open
+// (the writes that were applied are flushed to the files first). It must be called without holding checkpointMutex
+func (d *DB) discardFailedWrites() {
+	if atomic.LoadUint32(&d.closed) > 0 {
+		return // Close already emptied it
+	}
+	if err := d.checkpoint(); err != nil {
+		d.logger.Errorf("failed to remove failed writes from the write-ahead log: %s", err)
+	}
+}
+
+// syncFiles flushes all the HashDisk and ValuesDisk files to disk
+func (d *DB) syncFiles() error {
+	// Values first so that a key on disk always points to a value on disk
+	d.openValuesDiskMutex.RLock()
+	if len(d.openValuesDisk) == 0 {
+		d.openValuesDiskMutex.RUnlock()
+		return ErrDBClosed
+	}
+	var errors []error
+	for _, vd := range d.openValuesDisk {
+		errors = append(errors, vd.Sync())
+	}
+	d.openValuesDiskMutex.RUnlock()
+
+	d.openHashDiskMutex.RLock()
+	if len(d.openHashDisk) == 0 {
+		d.openHashDiskMutex.RUnlock()
+		return ErrDBClosed
+	}
+	for _, hd := range d.openHashDisk {
+		errors = append(errors, hd.Sync())
+	}
+	d.openHashDiskMutex.RUnlock()
+	return firstError(errors...)
 }
 
 // Close the database, flushing all pending operations to disk.
 // It is not safe to call any Read or Write after a Close
 func (d *DB) Close() error {
 	atomic.StoreUint32(&d.closed, 1)
+	d.leases.close()
+	if d.wal != nil {
+		d.checkpointMutex.Lock()
+		defer d.checkpointMutex.Unlock()
+	}
 	d.openHashDiskMutex.Lock()
 	defer d.openHashDiskMutex.Unlock()
 	d.openValuesDiskMutex.Lock()
 	defer d.openValuesDiskMutex.Unlock()
 
-	// Close all the databases
 	var errors []error
+	if d.wal != nil {
+		// Only empty the log once we know everything it contains is on disk
+		for _, vd := range d.openValuesDisk {
+			errors = append(errors, vd.Sync())
+		}
+		for _, hd := range d.openHashDisk {
+			errors = append(errors, hd.Sync())
+		}
+		if firstError(errors...) == nil {
+			errors = append(errors, d.wal.Truncate())
+		}
+		errors = append(errors, d.wal.Close())
+	}
+
+	// Close all the databases
 	for _, vd := range d.openValuesDisk {
 		err := vd.Close()
 		errors = append(errors, err)
@@ -312,6 +1001,13 @@ func (d *DB) Close() error {
 	}
 	d.openHashDisk = nil
 
+	d.sortedRunsMutex.Lock()
+	for _, r := range d.sortedRuns {
+		errors = append(errors, r.Close())
+	}
+	d.sortedRuns = nil
+	d.sortedRunsMutex.Unlock()
+
 	return firstError(errors...)
 }
 
@@ -319,27 +1015,26 @@ func (d *DB) Close() error {
 //   - rotates HashDisk when load factor is high (and we will soon disallow writes)
 //   - rotates ValuesDisk when offset is near the max size
 func (d *DB) rotate() error {
+	d.rotateMutex.Lock()
+	defer d.rotateMutex.Unlock()
+
 	// First check HashDisk
 	d.openHashDiskMutex.RLock()
 	if len(d.openHashDisk) == 0 {
 		d.openHashDiskMutex.RUnlock()
 		return ErrDBClosed
 	}
-	nbDBs := len(d.openHashDisk)
-	load := d.openHashDisk[nbDBs-1].Load()
+	current := d.openHashDisk[len(d.openHashDisk)-1].FileIndex
+	load := d.openHashDisk[len(d.openHashDisk)-1].Load()
 	d.openHashDiskMutex.RUnlock()
 	if load > rotateHashDiskMaxLoad {
 		// We need to rotate
-		fmt.Println("kvimd: HashDisk database is full, creating a new one")
-		file := createHashDiskPath(uint32(nbDBs))
-		path := filepath.Join(d.RootPath, file)
-		newDB, err := newHashDisk(path, int64(d.fileSize))
+		d.logger.Infof("HashDisk database is full, creating a new one")
+		index, err := d.addHashDisk()
 		if err != nil {
 			return err
 		}
-		d.openHashDiskMutex.Lock()
-		d.openHashDisk = append(d.openHashDisk, newDB)
-		d.openHashDiskMutex.Unlock()
+		d.hooks.rotate(RotateEvent{Full: createHashDiskPath(current), New: createHashDiskPath(index)})
 	}
 
 	// Then check ValuesDisk
@@ -348,23 +1043,198 @@ func (d *DB) rotate() error {
 		d.openValuesDiskMutex.RUnlock()
 		return ErrDBClosed
 	}
-	index := d.currentValuesDiskIndex
-	load = d.openValuesDisk[index].Load()
+	current = d.currentValuesDiskIndex
+	load = d.openValuesDisk[current].Load()
 	d.openValuesDiskMutex.RUnlock()
 	if load > rotateValuesDiskMaxLoad {
 		// We need to rotate
-		fmt.Println("kvimd: ValuesDisk database is full, creating a new one")
-		index++
-		file := createValuesDiskPath(index)
-		path := filepath.Join(d.RootPath, file)
-		db, err := newValuesDisk(path, d.fileSize, index)
+		d.logger.Infof("ValuesDisk database is full, creating a new one")
+		index, err := d.addValuesDisk()
+		if err != nil {
+			return err
+		}
+		d.hooks.rotate(RotateEvent{Full: createValuesDiskPath(current), New: createValuesDiskPath(index)})
+	}
+	return nil
+}
+
+// openWriteAheadLog replays the write-ahead log (if there is one) and keeps it open if enabled is true
+func (d *DB) openWriteAheadLog(enabled bool) error {
+	path := filepath.Join(d.RootPath, walFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) && !enabled {
+		return nil
+	}
+	wal, err := newWriteAheadLog(path, d.keySize)
+	if err != nil {
+		return err
+	}
+	var replayed int
+	size := wal.Size()
+	err = wal.Replay(func(key, value []byte) error {
+		err := d.write(key, value, false)
+		if cause := errors.Cause(err); cause == ErrValueTooBig || cause == ErrNoSpace {
+			// The write can't succeed, it already failed when it was logged (see discardFailedWrites)
+			d.logger.Errorf("skipped a write of the write-ahead log: %s", err)
+			return nil
+		}
+		if err == nil {
+			replayed++
+		}
+		return err
+	})
+	if err == nil {
+		err = d.syncFiles()
+	}
+	if err == nil && (replayed > 0 || wal.Size() < size) {
+		d.logger.Infof("replayed %d writes from the write-ahead log", replayed)
+		d.hooks.recover(RecoverEvent{Writes: replayed, Truncated: size - wal.Size()})
+	}
+	if err == nil {
+		err = wal.Truncate()
+	}
+	if err != nil || !enabled {
+		wal.Close()
 		if err != nil {
 			return err
 		}
-		d.openValuesDiskMutex.Lock()
-		d.openValuesDisk[index] = db
-		d.currentValuesDiskIndex = index
-		d.openValuesDiskMutex.Unlock()
+		return os.Remove(path)
+	}
+	d.wal = wal
+	return nil
+}
+
+// updateManifest applies fn to a copy of the manifest, persists it and then makes it the current one
+func (d *DB) updateManifest(fn func(m *manifest)) error {
+	d.manifestMutex.Lock()
+	defer d.manifestMutex.Unlock()
+	m := d.manifest.clone()
+	fn(m)
+	if err := m.save(d.RootPath); err != nil {
+		return err
 	}
+	d.manifest = m
 	return nil
 }
+
+// createFile creates a new database file in a crash-safe way: the file is first registered as pending
+// in the manifest, then created by open and finally committed to the manifest with commit
+func (d *DB) createFile(file string, open func(path string) error, commit func(m *manifest)) error {
+	err := d.updateManifest(func(m *manifest) {
+		m.Pending = append(m.Pending, file)
+	})
+	if err != nil {
+		return err
+	}
+	if err := open(filepath.Join(d.RootPath, file)); err != nil {
+		return err
+	}
+	return d.updateManifest(func(m *manifest) {
+		commit(m)
+		m.Pending = removeFile(m.Pending, file)
+	})
+}
+
+// removeFile returns files without file
+func removeFile(files []string, file string) []string {
+	for i, f := range files {
+		if f == file {
+			return append(files[:i], files[i+1:]...)
+		}
+	}
+	return files
+}
+
+// nextFileSize returns the size of the file that follows one of size last (0 if there is none):
+// last grown by growth, never smaller than base and never max or more
+func nextFileSize(base, last int64, growth float64, maxSize int64) int64 {
+	if last == 0 || growth <= 1 {
+		return base
+	}
+	size := int64(float64(last) * growth)
+	if size >= maxSize || size < last { // size < last if it overflowed
+		size = maxSize - 1
+	}
+	if size < base {
+		size = base
+	}
+	return size
+}
+
+// addHashDisk creates the next HashDisk database, makes it the one we write to and returns its index
+func (d *DB) addHashDisk() (uint32, error) {
+	d.manifestMutex.Lock()
+	index := d.manifest.nextHashDisk()
+	d.manifestMutex.Unlock()
+
+	var last int64
+	d.openHashDiskMutex.RLock()
+	if len(d.openHashDisk) > 0 {
+		last = d.openHashDisk[len(d.openHashDisk)-1].Size()
+	}
+	d.openHashDiskMutex.RUnlock()
+	size := nextFileSize(d.hashDiskSize, last, d.hashDiskGrowth, d.maxHashDiskSize)
+
+	var hd *hashDisk
+	err := d.createFile(createHashDiskPath(index), func(path string) error {
+		var err error
+		hd, err = newHashDisk(path, size, index, d.hashDiskConfig())
+		return err
+	}, func(m *manifest) {
+		m.HashDisks = append(m.HashDisks, index)
+	})
+	if err != nil {
+		if hd != nil {
+			hd.Close()
+		}
+		return 0, err
+	}
+
+	d.openHashDiskMutex.Lock()
+	defer d.openHashDiskMutex.Unlock()
+	if atomic.LoadUint32(&d.closed) > 0 {
+		hd.Close()
+		return 0, ErrDBClosed
+	}
+	d.openHashDisk = append(d.openHashDisk, hd)
+	return index, nil
+}
+
+// addValuesDisk creates the next ValuesDisk database, makes it the one we write to and returns its index
+func (d *DB) addValuesDisk() (uint32, error) {
+	d.manifestMutex.Lock()
+	index := d.manifest.nextValuesDisk()
+	d.manifestMutex.Unlock()
+
+	var last int64
+	d.openValuesDiskMutex.RLock()
+	if vd, ok := d.openValuesDisk[d.currentValuesDiskIndex]; ok {
+		last = int64(vd.MaxSize)
+	}
+	d.openValuesDiskMutex.RUnlock()
+	size := nextFileSize(d.valuesDiskSize, last, d.valuesDiskGrowth, d.maxValuesDiskSize)
+
+	var vd *valuesDisk
+	err := d.createFile(createValuesDiskPath(index), func(path string) error {
+		var err error
+		vd, err = newValuesDisk(path, size, index)
+		return err
+	}, func(m *manifest) {
+		m.ValuesDisks = append(m.ValuesDisks, index)
+	})
+	if err != nil {
+		if vd != nil {
+			vd.Close()
+		}
+		return 0, err
+	}
+
+	d.openValuesDiskMutex.Lock()
+	defer d.openValuesDiskMutex.Unlock()
+	if atomic.LoadUint32(&d.closed) > 0 {
+		vd.Close()
+		return 0, ErrDBClosed
+	}
+	d.openValuesDisk[index] = vd
+	d.currentValuesDiskIndex = index
+	return index, nil
+}
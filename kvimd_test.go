@@ -1,11 +1,18 @@
 package kvimd
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,7 +26,7 @@ type kvimdTestCase struct {
 }
 
 func generateKvimdTest() kvimdTestCase {
-	key := make([]byte, keySize)
+	key := make([]byte, defaultKeySize)
 	randbo.Read(key)
 	valueLen := rand.Intn(kvimdTestValueAvgSize * 2) // Value length will be between 0 and 2*Avg
 	value := make([]byte, valueLen)
@@ -39,8 +46,8 @@ func TestKvimdMaxSize(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	// Test that we can only create files that are < 2 << 31-1
-	size := uint32(2<<31 - 1)
-	_, err = NewDB(dir, size)
+	size := int64(2<<31 - 1)
+	_, err = NewDB(dir, Options{FileSize: size})
 	require.Equal(t, ErrFileTooBig, err)
 }
 
@@ -51,7 +58,7 @@ func TestKvimdWriteRead(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	db, err := NewDB(dir, testFileSize)
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
 	require.NoError(t, err)
 	defer func() {
 		err = db.Close()
@@ -74,6 +81,201 @@ func TestKvimdWriteRead(t *testing.T) {
 	}
 }
 
+func TestKvimdReadMany(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
+	require.NoError(t, err)
+
+	tests := make([]kvimdTestCase, 257)
+	keys := make([][]byte, len(tests))
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		keys[i] = tests[i].Key
+		if i%10 == 0 {
+			continue // Not in the database
+		}
+		err = db.Write(tests[i].Key, tests[i].Value)
+		require.NoError(t, err)
+	}
+	keys = append(keys, []byte("invalid"))
+
+	values, errs, err := db.ReadMany(keys)
+	require.NoError(t, err)
+	require.Len(t, values, len(keys))
+	require.Len(t, errs, len(keys))
+	for i, test := range tests {
+		if i%10 == 0 {
+			require.Equal(t, ErrKeyNotFound, errs[i])
+			continue
+		}
+		require.NoError(t, errs[i])
+		require.Equal(t, test.Value, values[i])
+	}
+	require.Equal(t, ErrInvalidKey, errs[len(tests)])
+
+	err = db.Close()
+	require.NoError(t, err)
+	_, _, err = db.ReadMany(keys)
+	require.Equal(t, ErrDBClosed, err)
+}
+
+func TestKvimdHasLocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+
+	present := generateKvimdTest()
+	err = db.Write(present.Key, present.Value)
+	require.NoError(t, err)
+	empty := generateKvimdTest()
+	err = db.Write(empty.Key, []byte{})
+	require.NoError(t, err)
+	missing := generateKvimdTest()
+
+	found, err := db.Has(present.Key)
+	require.NoError(t, err)
+	require.True(t, found)
+	found, err = db.Has(missing.Key)
+	require.NoError(t, err)
+	require.False(t, found)
+	_, err = db.Has([]byte("invalid"))
+	require.Equal(t, ErrInvalidKey, err)
+
+	founds, err := db.HasMany([][]byte{missing.Key, present.Key, empty.Key})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, true, true}, founds)
+	_, err = db.HasMany([][]byte{present.Key, []byte("invalid")})
+	require.Equal(t, ErrInvalidKey, err)
+
+	location, err := db.Locate(present.Key)
+	require.NoError(t, err)
+	require.Equal(t, len(present.Value), location.Size)
+	location, err = db.Locate(empty.Key)
+	require.NoError(t, err)
+	require.Equal(t, 0, location.Size)
+	_, err = db.Locate(missing.Key)
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestKvimdView(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
+	require.NoError(t, err)
+
+	tests := make([]kvimdTestCase, 100)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		err = db.Write(tests[i].Key, tests[i].Value)
+		require.NoError(t, err)
+	}
+	for _, test := range tests {
+		err = db.View(test.Key, func(value []byte) error {
+			require.Equal(t, test.Value, value)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	err = db.View(generateKvimdTest().Key, func(value []byte) error {
+		t.Fatal("fn should not be called for a missing key")
+		return nil
+	})
+	require.Equal(t, ErrKeyNotFound, err)
+	fnErr := errors.New("fn error")
+	err = db.View(tests[0].Key, func(value []byte) error {
+		return fnErr
+	})
+	require.Equal(t, fnErr, err)
+
+	// Close waits for the running views to return
+	viewing := make(chan struct{})
+	closed := make(chan struct{})
+	go func() {
+		db.View(tests[0].Key, func(value []byte) error {
+			close(viewing)
+			time.Sleep(50 * time.Millisecond)
+			select {
+			case <-closed:
+				t.Error("database was closed while viewing a value")
+			default:
+			}
+			require.Equal(t, tests[0].Value, value)
+			return nil
+		})
+	}()
+	<-viewing
+	err = db.Close()
+	close(closed)
+	require.NoError(t, err)
+	err = db.View(tests[0].Key, func(value []byte) error { return nil })
+	require.Equal(t, ErrDBClosed, err)
+}
+
+func TestKvimdOpenValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
+	require.NoError(t, err)
+
+	key := generateKvimdTest().Key
+	value := make([]byte, 1<<20)
+	randbo.Read(value)
+	err = db.Write(key, value)
+	require.NoError(t, err)
+
+	r, err := db.Open(key)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(value)), r.Size())
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, r)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(value)), n)
+	require.Equal(t, value, buf.Bytes())
+
+	// Random access
+	part := make([]byte, 100)
+	_, err = r.ReadAt(part, 1000)
+	require.NoError(t, err)
+	require.Equal(t, value[1000:1100], part)
+	_, err = r.Seek(-10, io.SeekEnd)
+	require.NoError(t, err)
+	end, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, value[len(value)-10:], end)
+
+	_, err = db.Open(generateKvimdTest().Key)
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// Close waits for the reader to be closed
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("database was closed while a reader was open")
+	default:
+	}
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close()) // Closing twice is fine
+	require.NoError(t, <-closed)
+}
+
 func TestKvimdCloseOpen(t *testing.T) {
 	// Test that we correctly reload the DB after we close and reopen
 	testsSample := 257
@@ -81,7 +283,7 @@ func TestKvimdCloseOpen(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	db, err := NewDB(dir, testFileSize)
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
 	require.NoError(t, err)
 
 	tests := make([]kvimdTestCase, testsSample)
@@ -96,7 +298,7 @@ func TestKvimdCloseOpen(t *testing.T) {
 	// Now close DB and reopen
 	err = db.Close()
 	require.NoError(t, err)
-	db, err = NewDB(dir, testFileSize)
+	db, err = NewDB(dir, Options{FileSize: testFileSize})
 	require.NoError(t, err)
 	defer func() {
 		err = db.Close()
@@ -111,13 +313,537 @@ func TestKvimdCloseOpen(t *testing.T) {
 	}
 }
 
+func TestKvimdReopenSameFiles(t *testing.T) {
+	// Test that reopening the database many times (i.e: a crash loop) doesn't create new files
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := make([]kvimdTestCase, 10)
+	for i := range tests {
+		db, err := NewDB(dir, Options{FileSize: testFileSize})
+		require.NoError(t, err)
+		tests[i] = generateKvimdTest()
+		err = db.Write(tests[i].Key, tests[i].Value)
+		require.NoError(t, err)
+		err = db.Close()
+		require.NoError(t, err)
+	}
+
+	files, err := listDatabaseFiles(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+}
+
+func TestKvimdValuesDiskGaps(t *testing.T) {
+	setup := func(t *testing.T) (string, []kvimdTestCase) {
+		dir, err := ioutil.TempDir("", "kvimd")
+		require.NoError(t, err)
+		db, err := NewDB(dir, Options{FileSize: testFileSize})
+		require.NoError(t, err)
+		tests := make([]kvimdTestCase, 100)
+		for i := range tests {
+			tests[i] = generateKvimdTest()
+			require.NoError(t, db.Write(tests[i].Key, tests[i].Value))
+		}
+		require.NoError(t, db.Close())
+		return dir, tests
+	}
+	// setValuesDisks makes the manifest list indexes as the ValuesDisks of the database
+	setValuesDisks := func(t *testing.T, dir string, indexes ...uint32) {
+		m, err := loadManifest(dir)
+		require.NoError(t, err)
+		m.ValuesDisks = indexes
+		require.NoError(t, m.save(dir))
+	}
+
+	t.Run("gap", func(t *testing.T) {
+		// A ValuesDisk that nothing references can be missing, the others keep their index
+		dir, tests := setup(t)
+		defer os.RemoveAll(dir)
+		vd, err := newValuesDisk(filepath.Join(dir, createValuesDiskPath(2)), testFileSize, 2)
+		require.NoError(t, err)
+		require.NoError(t, vd.Close())
+		setValuesDisks(t, dir, 0, 2)
+
+		db, err := NewDB(dir, Options{})
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, db.Close())
+		}()
+		require.Equal(t, uint32(2), db.currentValuesDiskIndex)
+		for _, test := range tests {
+			value, err := db.Read(test.Key)
+			require.NoError(t, err)
+			require.Equal(t, test.Value, value)
+		}
+		test := generateKvimdTest()
+		require.NoError(t, db.Write(test.Key, test.Value))
+		loc, err := db.Locate(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, uint32(2), loc.FileIndex)
+	})
+	t.Run("missing", func(t *testing.T) {
+		dir, _ := setup(t)
+		defer os.RemoveAll(dir)
+		require.NoError(t, os.Remove(filepath.Join(dir, createValuesDiskPath(0))))
+		vd, err := newValuesDisk(filepath.Join(dir, createValuesDiskPath(1)), testFileSize, 1)
+		require.NoError(t, err)
+		require.NoError(t, vd.Close())
+		setValuesDisks(t, dir, 1)
+
+		_, err = NewDB(dir, Options{})
+		require.Equal(t, ErrDanglingReference, errors.Cause(err))
+	})
+	t.Run("renumbered", func(t *testing.T) {
+		dir, _ := setup(t)
+		defer os.RemoveAll(dir)
+		require.NoError(t, os.Rename(filepath.Join(dir, createValuesDiskPath(0)), filepath.Join(dir, createValuesDiskPath(5))))
+		setValuesDisks(t, dir, 5)
+
+		_, err := NewDB(dir, Options{})
+		require.Equal(t, ErrDanglingReference, errors.Cause(err))
+	})
+}
+
+func TestKvimdRobinHood(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Small files so that we rotate HashDisks
+	db, err := NewDB(dir, Options{FileSize: 1 << 20, Probing: ProbingRobinHood})
+	require.NoError(t, err)
+	tests := make([]kvimdTestCase, 40000)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		err = db.Write(tests[i].Key, tests[i].Value)
+		require.NoError(t, err)
+	}
+	require.True(t, len(db.manifest.HashDisks) > 1)
+	require.NoError(t, db.Close())
+
+	// The probing is persisted
+	db, err = NewDB(dir, Options{})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	require.Equal(t, ProbingRobinHood, db.probing)
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+	count := 0
+	err = db.IterateKeys(func(key []byte) error {
+		count++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(tests), count)
+}
+
+func TestKvimdHasher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: 1 << 20, Hasher: XXH3Hasher{}})
+	require.NoError(t, err)
+	tests := make([]kvimdTestCase, 10000)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		err = db.Write(tests[i].Key, tests[i].Value)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	// The hasher is persisted
+	db, err = NewDB(dir, Options{})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	require.Equal(t, XXH3Hasher{}, db.hasher)
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+}
+
+func TestKvimdLargeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: 1 << 20, LargeFiles: true})
+	require.NoError(t, err)
+	tests := make([]kvimdTestCase, 10000)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		err = db.Write(tests[i].Key, tests[i].Value)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	// The layout is persisted
+	db, err = NewDB(dir, Options{})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	require.True(t, db.largeFiles)
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+	count := 0
+	err = db.Scan(nil, nil, func(key, value []byte) error {
+		count++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(tests), count)
+}
+
+func TestKvimdFileSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Small HashDisks that double every rotation
+	db, err := NewDB(dir, Options{HashDiskSize: 64 << 10, ValuesDiskSize: 16 << 20, HashDiskGrowth: 2})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	tests := make([]kvimdTestCase, 20000)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		err = db.Write(tests[i].Key, tests[i].Value)
+		require.NoError(t, err)
+	}
+	require.True(t, len(db.openHashDisk) > 2)
+	for i, hd := range db.openHashDisk[1:] {
+		require.InDelta(t, 2*db.openHashDisk[i].Size(), hd.Size(), float64(hd.entrySize))
+	}
+	require.Len(t, db.openValuesDisk, 1)
+	require.Equal(t, uint64(16<<20), db.openValuesDisk[0].MaxSize)
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+}
+
+func TestKvimdMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// ValuesDisks that quadruple every rotation, up to 8Mb
+	opts := Options{HashDiskSize: 1 << 20, ValuesDiskSize: 1 << 20, ValuesDiskGrowth: 4, MaxFileSize: 8 << 20, LargeFiles: true}
+	db, err := NewDB(dir, opts)
+	require.NoError(t, err)
+	tests := make([]kvimdTestCase, 8000)
+	for i := range tests {
+		tests[i].Key = make([]byte, defaultKeySize)
+		randbo.Read(tests[i].Key)
+		tests[i].Value = make([]byte, 4<<10)
+		randbo.Read(tests[i].Value)
+		err = db.Write(tests[i].Key, tests[i].Value)
+		require.NoError(t, err)
+	}
+	// Once they reach the max size, they stop growing
+	var sizes []uint64
+	for _, index := range db.manifest.ValuesDisks {
+		sizes = append(sizes, db.openValuesDisk[index].MaxSize)
+	}
+	require.True(t, len(sizes) > 4)
+	require.Equal(t, []uint64{1 << 20, 4 << 20}, sizes[:2])
+	for _, size := range sizes[2:] {
+		require.Equal(t, uint64(8<<20-1), size)
+	}
+	require.NoError(t, db.Close())
+
+	// The max size is persisted
+	db, err = NewDB(dir, Options{})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	require.Equal(t, int64(8<<20), db.maxValuesDiskSize)
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+}
+
+func TestNextFileSize(t *testing.T) {
+	require.Equal(t, int64(100), nextFileSize(100, 0, 2, 1000))   // First file
+	require.Equal(t, int64(100), nextFileSize(100, 300, 1, 1000)) // No growth
+	require.Equal(t, int64(600), nextFileSize(100, 300, 2, 1000))
+	require.Equal(t, int64(999), nextFileSize(100, 600, 2, 1000)) // Capped
+	require.Equal(t, int64(500), nextFileSize(500, 100, 2, 1000)) // Never smaller than the base size
+}
+
+func TestKvimdSync(t *testing.T) {
+	durabilities := map[string]Durability{
+		"none":     DurabilityNone,
+		"periodic": DurabilityPeriodic,
+		"sync":     DurabilitySync,
+	}
+	for name, durability := range durabilities {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kvimd")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			opts := Options{FileSize: testFileSize, Durability: durability, SyncInterval: 10 * time.Millisecond}
+			db, err := NewDB(dir, opts)
+			require.NoError(t, err)
+
+			tests := make([]kvimdTestCase, 100)
+			for i := range tests {
+				tests[i] = generateKvimdTest()
+				err = db.Write(tests[i].Key, tests[i].Value)
+				require.NoError(t, err)
+			}
+			time.Sleep(20 * time.Millisecond) // Let the periodic sync run
+			err = db.Sync()
+			require.NoError(t, err)
+			for _, test := range tests {
+				value, err := db.Read(test.Key)
+				require.NoError(t, err)
+				require.Equal(t, test.Value, value)
+			}
+
+			err = db.Close()
+			require.NoError(t, err)
+			require.Equal(t, ErrDBClosed, db.Sync())
+		})
+	}
+}
+
+func TestKvimdWriteAheadLog(t *testing.T) {
+	// Test that writes are recovered from the log if they didn't make it to the files
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := Options{FileSize: testFileSize, WriteAheadLog: true}
+	db, err := NewDB(dir, opts)
+	require.NoError(t, err)
+	tests := make([]kvimdTestCase, 100)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		err = db.Write(tests[i].Key, tests[i].Value)
+		require.NoError(t, err)
+	}
+	// Keep the log as it is before Close checkpoints it
+	log, err := ioutil.ReadFile(filepath.Join(dir, walFile))
+	require.NoError(t, err)
+	require.NotEmpty(t, log)
+	err = db.Close()
+	require.NoError(t, err)
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+
+	// Now simulate we lost everything but the log
+	err = os.RemoveAll(dir)
+	require.NoError(t, err)
+	db, err = NewDB(dir, opts)
+	require.NoError(t, err)
+	err = db.Close()
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, walFile), log, 0644)
+	require.NoError(t, err)
+
+	// The log is also replayed when it's not enabled anymore
+	db, err = NewDB(dir, Options{})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+	_, err = os.Stat(filepath.Join(dir, walFile))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestKvimdWriteBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+
+	existing := generateKvimdTest()
+	err = db.Write(existing.Key, existing.Value)
+	require.NoError(t, err)
+
+	tests := make([]kvimdTestCase, 100)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+	}
+	tests[10] = tests[3]                                               // Duplicate in the batch
+	tests[20] = kvimdTestCase{Key: existing.Key, Value: []byte("new")} // Already in the database
+	tests[30].Key = tests[30].Key[:defaultKeySize-1]                   // Invalid key
+	keys := make([][]byte, len(tests))
+	values := make([][]byte, len(tests))
+	for i, test := range tests {
+		keys[i], values[i] = test.Key, test.Value
+	}
+
+	errs, err := db.WriteBatch(keys, values)
+	require.NoError(t, err)
+	require.Len(t, errs, len(tests))
+	for i, test := range tests {
+		if i == 30 {
+			require.Equal(t, ErrInvalidKey, errs[i])
+			continue
+		}
+		require.NoError(t, errs[i])
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		if i == 20 {
+			require.Equal(t, existing.Value, value) // We never override
+		} else {
+			require.Equal(t, test.Value, value)
+		}
+	}
+
+	_, err = db.WriteBatch(keys, values[1:])
+	require.Error(t, err)
+}
+
+func TestKvimdWriteBatchRotate(t *testing.T) {
+	// Test a batch that doesn't fit in a single ValuesDisk nor in a single HashDisk
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: 1 << 20})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+
+	tests := make([]kvimdTestCase, 40000)
+	keys := make([][]byte, len(tests))
+	values := make([][]byte, len(tests))
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		keys[i], values[i] = tests[i].Key, tests[i].Value
+	}
+	errs, err := db.WriteBatch(keys, values)
+	require.NoError(t, err)
+	for i, test := range tests {
+		require.NoError(t, errs[i])
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+	require.True(t, len(db.manifest.HashDisks) > 1)
+	require.True(t, len(db.manifest.ValuesDisks) > 1)
+}
+
+func TestKvimdWriteBatchOversized(t *testing.T) {
+	// Test that a value that can't be stored only fails its own pair, and is not replayed from the write-ahead log
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := Options{FileSize: 1 << 20, WriteAheadLog: true}
+	db, err := NewDB(dir, opts)
+	require.NoError(t, err)
+	tests := make([]kvimdTestCase, 10)
+	keys := make([][]byte, len(tests))
+	values := make([][]byte, len(tests))
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		keys[i], values[i] = tests[i].Key, tests[i].Value
+	}
+	values[5] = make([]byte, 2<<20) // Bigger than a ValuesDisk
+	errs, err := db.WriteBatch(keys, values)
+	require.NoError(t, err)
+	for i, test := range tests {
+		if i == 5 {
+			require.Equal(t, ErrNoSpace, errors.Cause(errs[i]))
+			_, err = db.Read(test.Key)
+			require.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		require.NoError(t, errs[i])
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+	// The log was emptied (the other pairs are flushed to the files)
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+	err = db.Close()
+	require.NoError(t, err)
+
+	// A log with a write that can't succeed (e.g: we crashed before it was emptied) still opens
+	wal, err := newWriteAheadLog(filepath.Join(dir, walFile), defaultKeySize)
+	require.NoError(t, err)
+	added := generateKvimdTest()
+	require.NoError(t, wal.AppendBatch([][]byte{keys[5], added.Key}, [][]byte{values[5], added.Value}))
+	require.NoError(t, wal.Close())
+	db, err = NewDB(dir, opts)
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	_, err = db.Read(keys[5])
+	require.Equal(t, ErrKeyNotFound, err)
+	value, err := db.Read(added.Key)
+	require.NoError(t, err)
+	require.Equal(t, added.Value, value)
+}
+
 func TestKvimdWriteOnce(t *testing.T) {
 	// Setup
 	dir, err := ioutil.TempDir("", "kvimd")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	db, err := NewDB(dir, testFileSize)
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
 	require.NoError(t, err)
 	defer func() {
 		err = db.Close()
@@ -136,9 +862,105 @@ func TestKvimdWriteOnce(t *testing.T) {
 	require.Equal(t, result, testCase.Value)
 }
 
+func TestKvimdWriteOnceConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	vd := db.openValuesDisk[db.currentValuesDiskIndex]
+	start := atomic.LoadUint64(&vd.index)
+
+	// Test that concurrent writers of the same new keys only store each value once
+	tests := make([]kvimdTestCase, 50)
+	var expected uint64
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		expected += recordSize(len(tests[i].Value))
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			if w%2 == 0 {
+				for _, test := range tests {
+					require.NoError(t, db.Write(test.Key, test.Value))
+				}
+				return
+			}
+			// Batches in reverse order so that they lock keys other writers are waiting for
+			keys := make([][]byte, len(tests))
+			values := make([][]byte, len(tests))
+			for i, test := range tests {
+				keys[len(tests)-1-i], values[len(tests)-1-i] = test.Key, test.Value
+			}
+			errs, err := db.WriteBatch(keys, values)
+			require.NoError(t, err)
+			for _, err := range errs {
+				require.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	require.Equal(t, expected, atomic.LoadUint64(&vd.index)-start)
+	for _, test := range tests {
+		value, err := db.Read(test.Key)
+		require.NoError(t, err)
+		require.Equal(t, test.Value, value)
+	}
+}
+
+func TestKvimdKeySize(t *testing.T) {
+	// Test that we can use a non-default key size and that it is enforced on reopen
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := Options{FileSize: testFileSize, KeySize: 32}
+	db, err := NewDB(dir, opts)
+	require.NoError(t, err)
+	require.Equal(t, 32, db.KeySize())
+
+	key := make([]byte, 32)
+	randbo.Read(key)
+	value := []byte("sha256")
+	err = db.Write(key, value)
+	require.NoError(t, err)
+	// Keys of the wrong size are rejected
+	err = db.Write(key[:defaultKeySize], value)
+	require.Error(t, err)
+	_, err = db.Read(key[:defaultKeySize])
+	require.Equal(t, ErrInvalidKey, err)
+
+	err = db.Close()
+	require.NoError(t, err)
+
+	// Reopening with a different key size fails
+	_, err = NewDB(dir, Options{FileSize: testFileSize, KeySize: defaultKeySize})
+	require.Equal(t, ErrKeySize, errors.Cause(err))
+
+	// Not giving a key size reuses the one of the database
+	db, err = NewDB(dir, Options{})
+	require.NoError(t, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(t, err)
+	}()
+	result, err := db.Read(key)
+	require.NoError(t, err)
+	require.Equal(t, value, result)
+}
+
 func BenchmarkKvimdRandbo(b *testing.B) {
 	// Benchmark should to check how fast we can create a test case
-	b.SetBytes(keySize + kvimdTestValueAvgSize)
+	b.SetBytes(defaultKeySize + kvimdTestValueAvgSize)
 	for i := 0; i < b.N; i++ {
 		generateKvimdTest()
 	}
@@ -154,14 +976,14 @@ func BenchmarkKvimdWrite(b *testing.B) {
 		dir = out
 	}
 
-	db, err := NewDB(dir, benchFileSize)
+	db, err := NewDB(dir, Options{FileSize: benchFileSize})
 	require.NoError(b, err)
 	defer func() {
 		err = db.Close()
 		require.NoError(b, err)
 	}()
 
-	b.SetBytes(keySize + kvimdTestValueAvgSize)
+	b.SetBytes(defaultKeySize + kvimdTestValueAvgSize)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		test := generateKvimdTest()
@@ -173,12 +995,44 @@ func BenchmarkKvimdWrite(b *testing.B) {
 	b.StopTimer()
 }
 
+func BenchmarkKvimdWriteBatch(b *testing.B) {
+	batchSize := 1000
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: benchFileSize})
+	require.NoError(b, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(b, err)
+	}()
+
+	keys := make([][]byte, 0, batchSize)
+	values := make([][]byte, 0, batchSize)
+	b.SetBytes(defaultKeySize + kvimdTestValueAvgSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		test := generateKvimdTest()
+		keys = append(keys, test.Key)
+		values = append(values, test.Value)
+		if len(keys) == batchSize || i == b.N-1 {
+			_, err = db.WriteBatch(keys, values)
+			if err != nil {
+				b.Fatalf("Failed to write err=%s", err)
+			}
+			keys, values = keys[:0], values[:0]
+		}
+	}
+	b.StopTimer()
+}
+
 func BenchmarkKvimdReadSame(b *testing.B) {
 	dir, err := ioutil.TempDir("", "kvimd")
 	require.NoError(b, err)
 	defer os.RemoveAll(dir)
 
-	db, err := NewDB(dir, benchFileSize)
+	db, err := NewDB(dir, Options{FileSize: benchFileSize})
 	require.NoError(b, err)
 	defer func() {
 		err = db.Close()
@@ -189,7 +1043,7 @@ func BenchmarkKvimdReadSame(b *testing.B) {
 	err = db.Write(test.Key, test.Value)
 	require.NoError(b, err)
 
-	b.SetBytes(keySize + kvimdTestValueAvgSize)
+	b.SetBytes(defaultKeySize + kvimdTestValueAvgSize)
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
@@ -201,19 +1055,93 @@ func BenchmarkKvimdReadSame(b *testing.B) {
 	b.StopTimer()
 }
 
+func BenchmarkKvimdViewRandom(b *testing.B) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: benchFileSize})
+	require.NoError(b, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(b, err)
+	}()
+
+	b.SetBytes(defaultKeySize + kvimdTestValueAvgSize)
+
+	testKeys := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		test := generateKvimdTest()
+		testKeys[i] = test.Key
+		err = db.Write(test.Key, test.Value)
+		if err != nil {
+			b.Fatalf("Failed to write err=%s", err)
+		}
+	}
+
+	noop := func(value []byte) error { return nil }
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = db.View(testKeys[i], noop)
+		if err != nil {
+			b.Fatalf("Failed to view err=%s", err)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkKvimdReadManyRandom(b *testing.B) {
+	batchSize := 1000
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: benchFileSize})
+	require.NoError(b, err)
+	defer func() {
+		err = db.Close()
+		require.NoError(b, err)
+	}()
+
+	b.SetBytes(defaultKeySize + kvimdTestValueAvgSize)
+
+	testKeys := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		test := generateKvimdTest()
+		testKeys[i] = test.Key
+		err = db.Write(test.Key, test.Value)
+		if err != nil {
+			b.Fatalf("Failed to write err=%s", err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		end := i + batchSize
+		if end > b.N {
+			end = b.N
+		}
+		_, _, err = db.ReadMany(testKeys[i:end])
+		if err != nil {
+			b.Fatalf("Failed to read err=%s", err)
+		}
+	}
+	b.StopTimer()
+}
+
 func BenchmarkKvimdReadRandom(b *testing.B) {
 	dir, err := ioutil.TempDir("", "kvimd")
 	require.NoError(b, err)
 	defer os.RemoveAll(dir)
 
-	db, err := NewDB(dir, benchFileSize)
+	db, err := NewDB(dir, Options{FileSize: benchFileSize})
 	require.NoError(b, err)
 	defer func() {
 		err = db.Close()
 		require.NoError(b, err)
 	}()
 
-	b.SetBytes(keySize + kvimdTestValueAvgSize)
+	b.SetBytes(defaultKeySize + kvimdTestValueAvgSize)
 
 	testKeys := make([][]byte, b.N)
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,75 @@
+package kvimd
+
+import "sync"
+
+// leases counts the readers that are using slices of the mmapped files directly, so that
+// the files are not unmapped under their feet. Close waits for all of them to be released.
+// It is thread-safe
+type leases struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	count  int
+	closed bool
+	// deferred are run once there are no leases anymore (see afterRelease)
+	deferred []func()
+}
+
+func newLeases() *leases {
+	l := &leases{}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// acquire a new lease. Return false if leases are closed (no new lease can be acquired)
+func (l *leases) acquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// release a lease previously acquired
+func (l *leases) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.count == 1 && len(l.deferred) > 0 {
+		// Last lease, run the deferred functions before releasing it so that close waits for them
+		deferred := l.deferred
+		l.deferred = nil
+		l.mutex.Unlock()
+		for _, fn := range deferred {
+			fn()
+		}
+		l.mutex.Lock()
+	}
+	l.count--
+	if l.count == 0 {
+		l.cond.Broadcast()
+	}
+}
+
+// afterRelease runs fn once no lease is held anymore (right away if there are none, at the latest on close).
+// It is used to unmap files that were removed from the database but that readers might still use
+func (l *leases) afterRelease(fn func()) {
+	l.mutex.Lock()
+	if l.count > 0 {
+		l.deferred = append(l.deferred, fn)
+		l.mutex.Unlock()
+		return
+	}
+	l.mutex.Unlock()
+	fn()
+}
+
+// close prevents any new lease from being acquired and waits for all the current ones to be released
+func (l *leases) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	for l.count > 0 {
+		l.cond.Wait()
+	}
+}
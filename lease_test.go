@@ -0,0 +1,52 @@
+package kvimd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeases(t *testing.T) {
+	l := newLeases()
+	require.True(t, l.acquire())
+	require.True(t, l.acquire())
+
+	closed := make(chan struct{})
+	go func() {
+		l.close()
+		close(closed)
+	}()
+
+	// close waits for the current leases, but no new lease can be acquired
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("close returned before all the leases were released")
+	default:
+	}
+	require.False(t, l.acquire())
+
+	l.release()
+	l.release()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close didn't return once all the leases were released")
+	}
+}
+
+func TestLeasesAfterRelease(t *testing.T) {
+	l := newLeases()
+	ran := 0
+	l.afterRelease(func() { ran++ })
+	require.Equal(t, 1, ran) // No lease, run right away
+
+	require.True(t, l.acquire())
+	require.True(t, l.acquire())
+	l.afterRelease(func() { ran++ })
+	l.release()
+	require.Equal(t, 1, ran)
+	l.release()
+	require.Equal(t, 2, ran)
+}
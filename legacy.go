@@ -0,0 +1,280 @@
+package kvimd
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/pkg/errors"
+)
+
+// Databases created before the manifest have no MANIFEST, keys of defaultKeySize (it wasn't configurable yet)
+// and ValuesDisks in the original format: no header and no checksums. Their HashDisks are the same as the ones
+// of a new database with the default options.
+// They are migrated the first time they are opened (see migrateLegacyDatabase)
+
+// migrateSuffix is appended to the name of a file to get the name of its migrated copy
+const migrateSuffix = ".migrate"
+
+// legacyOffsets maps the offsets of the values of a legacy ValuesDisk to their offsets in the migrated one
+type legacyOffsets struct {
+	old []uint64 // Sorted
+	new []uint64
+}
+
+// translate returns the offset in the migrated ValuesDisk of the value that was at offset
+func (l *legacyOffsets) translate(offset uint64) (uint64, bool) {
+	i := sort.Search(len(l.old), func(i int) bool { return l.old[i] >= offset })
+	if i == len(l.old) || l.old[i] != offset {
+		return 0, false
+	}
+	return l.new[i], true
+}
+
+// migrateLegacyDatabase creates the manifest of the database created before there was one in root, made of files.
+// Its ValuesDisks are rewritten in the current format (only the values that are referenced, so that holes left by
+// crashes are dropped) and the offsets of its HashDisks are updated to match. The migrated files are written
+// next to the old ones (with migrateSuffix), once the manifest is saved they replace them (see manifest.Migrated).
+// If we crash before, the migration starts over on the next open
+func migrateLegacyDatabase(root string, files []string, opts Options) (*manifest, error) {
+	keySize := defaultKeySize
+	if opts.KeySize != 0 && opts.KeySize != keySize {
+		return nil, errors.Wrapf(ErrKeySize, "database has key size %d, got %d", keySize, opts.KeySize)
+	}
+	stale, err := listFiles(root, migratePattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list directory")
+	}
+	for _, f := range stale {
+		if err := os.Remove(filepath.Join(root, f)); err != nil {
+			return nil, errors.Wrapf(err, "failed to remove %s of a previous migration", f)
+		}
+	}
+
+	opts.KeySize = keySize
+	opts = opts.withDefaults()
+	m := &manifest{
+		FormatVersion: formatVersion,
+		KeySize:       keySize,
+		FileSize:      opts.FileSize,
+		HashFunction:  hashFunctionMurmur,
+		Probing:       probingLinear,
+		OffsetSize:    offsetSize32,
+	}
+	if err := m.setFileSizes(opts); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		index, err := getDBNumber(f)
+		if err != nil {
+			return nil, err
+		}
+		if hashDiskPattern.MatchString(f) {
+			m.HashDisks = append(m.HashDisks, uint32(index))
+		} else {
+			m.ValuesDisks = append(m.ValuesDisks, uint32(index))
+		}
+	}
+	sort.Slice(m.HashDisks, func(i, j int) bool { return m.HashDisks[i] < m.HashDisks[j] })
+	sort.Slice(m.ValuesDisks, func(i, j int) bool { return m.ValuesDisks[i] < m.ValuesDisks[j] })
+
+	// Find the values that are referenced
+	entrySize := uint64(keySize + 4 + 4)
+	references := make(map[uint32][]uint64)
+	for _, index := range m.HashDisks {
+		err := mapLegacyFile(filepath.Join(root, createHashDiskPath(index)), mmap.RDONLY, func(b mmap.MMap) error {
+			for offset := uint64(0); offset+entrySize <= uint64(len(b)); offset += entrySize {
+				if isZero(b[offset : offset+uint64(keySize)]) {
+					continue
+				}
+				location := b[offset+uint64(keySize):]
+				fileIndex := encoding.Uint32(location[0:4])
+				references[fileIndex] = append(references[fileIndex], uint64(encoding.Uint32(location[4:8])))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	offsets := make(map[uint32]*legacyOffsets)
+	for _, index := range m.ValuesDisks {
+		file := createValuesDiskPath(index)
+		o, err := migrateLegacyValuesDisk(filepath.Join(root, file), index, references[index])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to migrate %s", file)
+		}
+		offsets[index] = o
+		m.Migrated = append(m.Migrated, file)
+	}
+	for _, index := range m.HashDisks {
+		file := createHashDiskPath(index)
+		if err := migrateLegacyHashDisk(filepath.Join(root, file), keySize, offsets); err != nil {
+			return nil, errors.Wrapf(err, "failed to migrate %s", file)
+		}
+		m.Migrated = append(m.Migrated, file)
+	}
+	if err := syncDir(root); err != nil {
+		return nil, err
+	}
+	return m, m.save(root)
+}
+
+// migrateLegacyValuesDisk writes the values at offsets of the legacy ValuesDisk at path in a ValuesDisk
+// in the current format (path with migrateSuffix)
+func migrateLegacyValuesDisk(path string, index uint32, offsets []uint64) (*legacyOffsets, error) {
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	o := &legacyOffsets{}
+	for i, offset := range offsets {
+		if i == 0 || offset != offsets[i-1] {
+			o.old = append(o.old, offset)
+		}
+	}
+
+	var values [][]byte
+	err := mapLegacyFile(path, mmap.RDONLY, func(b mmap.MMap) error {
+		values = make([][]byte, len(o.old))
+		for i, offset := range o.old {
+			value, ok := legacyRecord(b, offset)
+			if !ok {
+				return errors.Wrapf(ErrCorrupted, "invalid value at offset %d", offset)
+			}
+			values[i] = value
+		}
+		// The values point into the mmap, the migrated file is written before it is unmapped
+		size := int64(len(b))
+		needed := uint64(valuesDiskHeaderSize)
+		for _, value := range values {
+			needed += recordSize(len(value))
+		}
+		if uint64(size) <= needed {
+			size = int64(needed) + 1
+		}
+		if size >= maxFileSize {
+			return ErrFileTooBig
+		}
+		vd, err := newValuesDisk(path+migrateSuffix, size, index)
+		if err != nil {
+			return err
+		}
+		o.new = make([]uint64, len(values))
+		for i, value := range values {
+			if o.new[i], err = vd.Set(value); err != nil {
+				vd.Close()
+				return err
+			}
+		}
+		return firstError(vd.Sync(), vd.file.Sync(), vd.Close())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// legacyRecord returns the value at offset of a legacy ValuesDisk: its length (uvarint, math.MaxUint32
+// for an empty value) followed by the value
+func legacyRecord(b []byte, offset uint64) ([]byte, bool) {
+	if offset >= uint64(len(b)) {
+		return nil, false
+	}
+	end := offset + binary.MaxVarintLen32
+	if end > uint64(len(b)) {
+		end = uint64(len(b))
+	}
+	valueSize, varintSize := binary.Uvarint(b[offset:end])
+	if varintSize <= 0 || valueSize == 0 {
+		return nil, false
+	}
+	if valueSize == math.MaxUint32 {
+		valueSize = 0
+	}
+	start := offset + uint64(varintSize)
+	if start+valueSize > uint64(len(b)) {
+		return nil, false
+	}
+	return b[start : start+valueSize], true
+}
+
+// migrateLegacyHashDisk copies the HashDisk at path (to path with migrateSuffix) with the offsets of
+// the values in the migrated ValuesDisks. Entries referencing a ValuesDisk that is not there are kept as is
+// (opening the database fails with ErrDanglingReference)
+func migrateLegacyHashDisk(path string, keySize int, offsets map[uint32]*legacyOffsets) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+migrateSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create file")
+	}
+	_, err1 := io.Copy(dst, src)
+	err2 := dst.Close()
+	if err := firstError(err1, err2); err != nil {
+		return errors.Wrap(err, "failed to copy file")
+	}
+
+	entrySize := uint64(keySize + 4 + 4)
+	return mapLegacyFile(path+migrateSuffix, mmap.RDWR, func(b mmap.MMap) error {
+		for offset := uint64(0); offset+entrySize <= uint64(len(b)); offset += entrySize {
+			if isZero(b[offset : offset+uint64(keySize)]) {
+				continue
+			}
+			location := b[offset+uint64(keySize):]
+			o, ok := offsets[encoding.Uint32(location[0:4])]
+			if !ok {
+				continue
+			}
+			fileOffset, ok := o.translate(uint64(encoding.Uint32(location[4:8])))
+			if !ok { // Can't happen, all the referenced values were migrated
+				return ErrCorrupted
+			}
+			encoding.PutUint32(location[4:8], uint32(fileOffset))
+		}
+		return b.Flush()
+	})
+}
+
+// mapLegacyFile calls fn with the content of the file at path, mmapped with prot
+func mapLegacyFile(path string, prot int, fn func(b mmap.MMap) error) error {
+	flag := os.O_RDONLY
+	if prot == mmap.RDWR {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to get file infos")
+	}
+	if info.Size() == 0 {
+		return errors.Wrapf(ErrCorrupted, "%s is empty", filepath.Base(path))
+	}
+	b, err := mmap.Map(f, prot, 0)
+	if err != nil {
+		return errors.Wrap(err, "failed to mmap file")
+	}
+	err1 := fn(b)
+	err2 := b.Unmap()
+	err3 := f.Sync()
+	return firstError(err1, err2, err3)
+}
+
+// isZero returns whether all the bytes of b are 0
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
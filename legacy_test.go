@@ -0,0 +1,135 @@
+package kvimd
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+const legacyTestFileSize = 1 << 20
+
+// writeLegacyDatabase writes in dir a database created before the manifest, with the values of tests spread over
+// 2 ValuesDisks (in the original format: no header and no checksums) and their keys in a single HashDisk
+func writeLegacyDatabase(t *testing.T, dir string, tests []kvimdTestCase) {
+	keySize := defaultKeySize
+	valuesDisks := [][]byte{make([]byte, legacyTestFileSize), make([]byte, legacyTestFileSize)}
+	indexes := []int{0, 100} // db1 starts with a hole, as concurrent writers could leave before a crash
+	hashDisk := make([]byte, legacyTestFileSize)
+	entrySize := keySize + 4 + 4
+	entries := uint64(legacyTestFileSize / entrySize)
+	for i, test := range tests {
+		fileIndex := i % 2
+		offset := indexes[fileIndex]
+		length := uint64(len(test.Value))
+		if length == 0 {
+			length = math.MaxUint32
+		}
+		n := binary.PutUvarint(valuesDisks[fileIndex][offset:], length)
+		n += copy(valuesDisks[fileIndex][offset+n:], test.Value)
+		indexes[fileIndex] += n
+
+		slot := MurmurHasher{}.Hash(test.Key) % entries
+		for !isZero(hashDisk[int(slot)*entrySize : int(slot)*entrySize+keySize]) {
+			slot = (slot + 1) % entries
+		}
+		entry := hashDisk[int(slot)*entrySize:]
+		copy(entry, test.Key)
+		encoding.PutUint32(entry[keySize:], uint32(fileIndex))
+		encoding.PutUint32(entry[keySize+4:], uint32(offset))
+	}
+	// A value that no key references
+	binary.PutUvarint(valuesDisks[1][indexes[1]:], 3)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, createHashDiskPath(0)), hashDisk, 0644))
+	for i, valuesDisk := range valuesDisks {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, createValuesDiskPath(uint32(i))), valuesDisk, 0644))
+	}
+}
+
+func generateLegacyTests() []kvimdTestCase {
+	tests := make([]kvimdTestCase, 1000)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+	}
+	tests[0].Value = []byte{}
+	return tests
+}
+
+func TestLegacyMigration(t *testing.T) {
+	check := func(t *testing.T, dir string, opts Options, tests []kvimdTestCase) {
+		db, err := NewDB(dir, opts)
+		require.NoError(t, err)
+		for _, test := range tests {
+			value, err := db.Read(test.Key)
+			require.NoError(t, err)
+			require.Equal(t, test.Value, value)
+		}
+		added := generateKvimdTest()
+		require.NoError(t, db.Write(added.Key, added.Value))
+		require.NoError(t, db.Close())
+
+		// Everything is still there once migrated
+		db, err = NewDB(dir, opts)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, db.Close())
+		}()
+		for _, test := range append(tests, added) {
+			value, err := db.Read(test.Key)
+			require.NoError(t, err)
+			require.Equal(t, test.Value, value)
+		}
+		migrated, err := listFiles(dir, migratePattern)
+		require.NoError(t, err)
+		require.Empty(t, migrated)
+		require.Equal(t, []uint32{0}, db.manifest.HashDisks)
+		require.Equal(t, []uint32{0, 1}, db.manifest.ValuesDisks)
+	}
+
+	t.Run("migrate", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "kvimd")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		tests := generateLegacyTests()
+		writeLegacyDatabase(t, dir, tests)
+
+		// The keys were always of the default size
+		_, err = NewDB(dir, Options{KeySize: 8})
+		require.Equal(t, ErrKeySize, errors.Cause(err))
+		_, err = os.Stat(filepath.Join(dir, manifestFile))
+		require.True(t, os.IsNotExist(err))
+		check(t, dir, Options{FileSize: legacyTestFileSize}, tests)
+	})
+	t.Run("crash_before_commit", func(t *testing.T) {
+		// Copies of a migration that didn't complete are started over
+		dir, err := ioutil.TempDir("", "kvimd")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		tests := generateLegacyTests()
+		writeLegacyDatabase(t, dir, tests)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, createValuesDiskPath(0)+migrateSuffix), []byte("partial"), 0644))
+		check(t, dir, Options{FileSize: legacyTestFileSize}, tests)
+	})
+	t.Run("crash_after_commit", func(t *testing.T) {
+		// The manifest was saved but the old files were not replaced yet
+		dir, err := ioutil.TempDir("", "kvimd")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		tests := generateLegacyTests()
+		writeLegacyDatabase(t, dir, tests)
+		files, err := listDatabaseFiles(dir)
+		require.NoError(t, err)
+		m, err := migrateLegacyDatabase(dir, files, Options{FileSize: legacyTestFileSize})
+		require.NoError(t, err)
+		require.Len(t, m.Migrated, 3)
+		// Only one of them was replaced
+		require.NoError(t, os.Rename(filepath.Join(dir, m.Migrated[0]+migrateSuffix), filepath.Join(dir, m.Migrated[0])))
+		check(t, dir, Options{}, tests)
+	})
+}
@@ -0,0 +1,432 @@
+package kvimd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	manifestFile = "MANIFEST"
+	// formatVersion is the version of the on-disk format. It needs to be bumped on any incompatible change
+	formatVersion        = 5
+	hashFunctionMurmur   = "murmur3"
+	hashFunctionIdentity = "identity"
+	hashFunctionXXH3     = "xxh3"
+	probingLinear        = "linear"
+	probingRobinHood     = "robinhood"
+	offsetSize32         = 4
+	offsetSize64         = 8 // Options.LargeFiles
+)
+
+// manifest describes what is in the database directory. It is atomically rewritten every time
+// a file is added or removed so that we never open a directory with files we don't know about.
+// It is **NOT THREAD-SAFE**, the DB rewrites a copy and swaps it under DB.manifestMutex
+type manifest struct {
+	FormatVersion int   `json:"format_version"`
+	KeySize       int   `json:"key_size"`
+	FileSize      int64 `json:"file_size"`
+	// HashDiskSize and ValuesDiskSize override FileSize for each kind of file (0 means FileSize)
+	HashDiskSize   int64 `json:"hash_disk_size,omitempty"`
+	ValuesDiskSize int64 `json:"values_disk_size,omitempty"`
+	// HashDiskGrowth and ValuesDiskGrowth are by how much each new file is bigger than the previous one (0 means 1)
+	HashDiskGrowth   float64  `json:"hash_disk_growth,omitempty"`
+	ValuesDiskGrowth float64  `json:"values_disk_growth,omitempty"`
+	MaxFileSize      int64    `json:"max_file_size,omitempty"` // Size the new files never reach (0 means the default, see maxFileSize)
+	HashFunction     string   `json:"hash_function"`
+	Probing          string   `json:"probing"`
+	OffsetSize       int      `json:"offset_size"`  // Size of the offsets in the ValuesDisks
+	HashDisks        []uint32 `json:"hash_disks"`   // Ordered from oldest to newest
+	ValuesDisks      []uint32 `json:"values_disks"` // Ordered from oldest to newest
+	// Pending are the files that are being created. If we crash before they are added to the manifest,
+	// nothing can reference them so they are deleted on the next open
+	Pending []string `json:"pending,omitempty"`
+	// Obsolete are the files that were removed from the database (see DB.Compact) but might not be deleted yet.
+	// They are deleted on the next open
+	Obsolete []string `json:"obsolete,omitempty"`
+	// Migrated are the files of a database created before the manifest that are replaced by their migrated copy
+	// (see migrateLegacyDatabase). They are replaced on the next open
+	Migrated []string `json:"migrated,omitempty"`
+}
+
+// openManifest loads the manifest of the database in root (or creates a new one) and checks
+// that it is compatible with opts and with the files present in the directory
+func openManifest(root string, opts Options) (*manifest, error) {
+	m, err := loadManifest(root)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		// New database, unless there are files of a database created before the manifest
+		files, err := listDatabaseFiles(root)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			// Database created before the manifest
+			m, err = migrateLegacyDatabase(root, files, opts)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to migrate database")
+			}
+		}
+	}
+	if m == nil {
+		opts = opts.withDefaults()
+		m = &manifest{
+			FormatVersion: formatVersion,
+			KeySize:       opts.KeySize,
+			FileSize:      opts.FileSize,
+			HashFunction:  hashFunctionMurmur,
+			Probing:       probingLinear,
+			OffsetSize:    offsetSize32,
+		}
+		if opts.Probing == ProbingRobinHood {
+			m.Probing = probingRobinHood
+		}
+		if opts.Hasher != nil {
+			m.HashFunction = opts.Hasher.Name()
+		}
+		if opts.LargeFiles {
+			m.OffsetSize = offsetSize64
+		}
+		if err := m.setFileSizes(opts); err != nil {
+			return nil, err
+		}
+		return m, m.save(root)
+	}
+
+	if m.FormatVersion == 3 {
+		// Version 3 is version 4 with only linear probing
+		m.FormatVersion = 4
+		m.Probing = probingLinear
+	}
+	if m.FormatVersion == 4 {
+		// Version 4 is version 5 with only uint32 offsets
+		m.FormatVersion = formatVersion
+		m.OffsetSize = offsetSize32
+	}
+	if m.FormatVersion != formatVersion {
+		return nil, errors.Wrapf(ErrIncompatible, "format version is %d, only %d is supported", m.FormatVersion, formatVersion)
+	}
+	if _, err := m.hasher(opts); err != nil {
+		return nil, err
+	}
+	if _, err := m.probing(); err != nil {
+		return nil, err
+	}
+	if _, err := m.largeFiles(); err != nil {
+		return nil, err
+	}
+	if opts.KeySize != 0 && opts.KeySize != m.KeySize {
+		return nil, errors.Wrapf(ErrKeySize, "database has key size %d, got %d", m.KeySize, opts.KeySize)
+	}
+	// Only used for new files, existing ones keep their size
+	if err := m.setFileSizes(opts); err != nil {
+		return nil, err
+	}
+
+	// The migrated copies of the files are committed, they replace the old ones
+	for _, f := range m.Migrated {
+		err := os.Rename(filepath.Join(root, f+migrateSuffix), filepath.Join(root, f))
+		if err != nil && !os.IsNotExist(err) { // It doesn't exist if it was already renamed
+			return nil, errors.Wrapf(err, "failed to replace %s with its migrated copy", f)
+		}
+	}
+	if len(m.Migrated) > 0 {
+		if err := syncDir(root); err != nil {
+			return nil, err
+		}
+	}
+	m.Migrated = nil
+
+	// Files that were never committed to the manifest can't be referenced, remove them
+	for _, f := range m.Pending {
+		if err := os.Remove(filepath.Join(root, f)); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "failed to remove pending file %s", f)
+		}
+	}
+	m.Pending = nil
+	for _, f := range m.Obsolete {
+		if err := os.Remove(filepath.Join(root, f)); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "failed to remove obsolete file %s", f)
+		}
+	}
+	m.Obsolete = nil
+
+	// Sorted runs and bloom filters are only derived from the HashDisks, remove the ones of HashDisks that are not there anymore
+	if err := m.removeStaleDerivedFiles(root); err != nil {
+		return nil, err
+	}
+
+	if err := m.check(root); err != nil {
+		return nil, err
+	}
+	return m, m.save(root)
+}
+
+// loadManifest reads the manifest of the database in root. If there is none, return a nil manifest
+func loadManifest(root string) (*manifest, error) {
+	content, err := ioutil.ReadFile(filepath.Join(root, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read manifest")
+	}
+	var m manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, errors.Wrapf(ErrManifest, "failed to decode manifest: %s", err)
+	}
+	return &m, nil
+}
+
+// save atomically replaces the manifest in root (write to a temporary file then rename)
+func (m *manifest) save(root string) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode manifest")
+	}
+	tmp := filepath.Join(root, manifestFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create manifest")
+	}
+	_, err1 := f.Write(content)
+	err2 := f.Sync()
+	err3 := f.Close()
+	if err := firstError(err1, err2, err3); err != nil {
+		return errors.Wrap(err, "failed to write manifest")
+	}
+	if err := os.Rename(tmp, filepath.Join(root, manifestFile)); err != nil {
+		return errors.Wrap(err, "failed to replace manifest")
+	}
+	return syncDir(root)
+}
+
+// probing returns the probing of the HashDisks of the database
+func (m *manifest) probing() (Probing, error) {
+	switch m.Probing {
+	case probingLinear:
+		return ProbingLinear, nil
+	case probingRobinHood:
+		return ProbingRobinHood, nil
+	}
+	return 0, errors.Wrapf(ErrIncompatible, "unknown probing %q", m.Probing)
+}
+
+// largeFiles returns whether the offsets in the ValuesDisks of the database are uint64
+func (m *manifest) largeFiles() (bool, error) {
+	switch m.OffsetSize {
+	case offsetSize32:
+		return false, nil
+	case offsetSize64:
+		return true, nil
+	}
+	return false, errors.Wrapf(ErrIncompatible, "unknown offset size %d", m.OffsetSize)
+}
+
+// setFileSizes sets the sizes of the new files to the ones of opts (those that are not set keep the sizes
+// the database was created with) and returns ErrFileTooBig if they would be too big for the layout of the database
+func (m *manifest) setFileSizes(opts Options) error {
+	probing, err := m.probing()
+	if err != nil {
+		return err
+	}
+	config := hashDiskConfig{KeySize: m.KeySize, Probing: probing, LargeFiles: m.OffsetSize == offsetSize64}
+
+	if opts.MaxFileSize != 0 {
+		if !config.LargeFiles && opts.MaxFileSize > maxFileSize {
+			return ErrFileTooBig
+		}
+		m.MaxFileSize = opts.MaxFileSize
+	}
+	if opts.FileSize != 0 {
+		// It is the size of both kinds of files
+		m.FileSize = opts.FileSize
+		m.HashDiskSize, m.ValuesDiskSize = 0, 0
+	}
+	if opts.ValuesDiskSize != 0 {
+		m.ValuesDiskSize = opts.ValuesDiskSize
+	}
+	if opts.HashDiskSize != 0 {
+		m.HashDiskSize = opts.HashDiskSize
+	} else if opts.AverageValueSize > 0 {
+		m.HashDiskSize = hashDiskSizeFor(m.valuesDiskSize(), opts.AverageValueSize, config, m.maxFileSize(config.maxFileSize()))
+	}
+	if opts.HashDiskGrowth != 0 {
+		m.HashDiskGrowth = opts.HashDiskGrowth
+	}
+	if opts.ValuesDiskGrowth != 0 {
+		m.ValuesDiskGrowth = opts.ValuesDiskGrowth
+	}
+
+	if m.hashDiskSize() >= m.maxFileSize(config.maxFileSize()) {
+		return ErrFileTooBig
+	}
+	if m.valuesDiskSize() >= m.maxFileSize(math.MaxInt64) {
+		return ErrFileTooBig
+	}
+	return nil
+}
+
+// maxFileSize returns the size that the new files never reach: MaxFileSize (by default 4Gb, or 64Gb with large files)
+// but no more than limit, the size from which a file can't be addressed
+func (m *manifest) maxFileSize(limit int64) int64 {
+	size := m.MaxFileSize
+	if size == 0 {
+		size = maxFileSize
+		if m.OffsetSize == offsetSize64 {
+			size = defaultMaxLargeFileSize
+		}
+	}
+	if size > limit {
+		return limit
+	}
+	return size
+}
+
+// hashDiskSize returns the size of the new HashDisks
+func (m *manifest) hashDiskSize() int64 {
+	if m.HashDiskSize != 0 {
+		return m.HashDiskSize
+	}
+	return m.FileSize
+}
+
+// valuesDiskSize returns the size of the new ValuesDisks
+func (m *manifest) valuesDiskSize() int64 {
+	if m.ValuesDiskSize != 0 {
+		return m.ValuesDiskSize
+	}
+	return m.FileSize
+}
+
+// hasher returns the hasher of the HashDisks of the database: opts.Hasher if it is the one
+// the database was created with, otherwise the builtin hasher of that name
+func (m *manifest) hasher(opts Options) (Hasher, error) {
+	if opts.Hasher != nil {
+		if opts.Hasher.Name() != m.HashFunction {
+			return nil, errors.Wrapf(ErrIncompatible, "database uses hash function %q, got %q", m.HashFunction, opts.Hasher.Name())
+		}
+		return opts.Hasher, nil
+	}
+	if h := builtinHasher(m.HashFunction); h != nil {
+		return h, nil
+	}
+	return nil, errors.Wrapf(ErrIncompatible, "unknown hash function %q, pass it in Options.Hasher", m.HashFunction)
+}
+
+// clone returns a deep copy of the manifest
+func (m *manifest) clone() *manifest {
+	c := *m
+	c.HashDisks = append([]uint32(nil), m.HashDisks...)
+	c.ValuesDisks = append([]uint32(nil), m.ValuesDisks...)
+	c.Pending = append([]string(nil), m.Pending...)
+	c.Obsolete = append([]string(nil), m.Obsolete...)
+	c.Migrated = append([]string(nil), m.Migrated...)
+	return &c
+}
+
+// check returns an error if a file of the manifest is missing or if there are files
+// in the directory that the manifest doesn't know about
+func (m *manifest) check(root string) error {
+	expected := make(map[string]bool)
+	for _, index := range m.HashDisks {
+		expected[createHashDiskPath(index)] = true
+	}
+	for _, index := range m.ValuesDisks {
+		expected[createValuesDiskPath(index)] = true
+	}
+	files, err := listDatabaseFiles(root)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !expected[f] {
+			return errors.Wrapf(ErrManifest, "file %s is not part of the database", f)
+		}
+		delete(expected, f)
+	}
+	for f := range expected {
+		return errors.Wrapf(ErrManifest, "file %s is missing", f)
+	}
+	return nil
+}
+
+// removeStaleDerivedFiles removes the sorted runs (see DB.Scan) and the bloom filters of HashDisks
+// that are not part of the database
+func (m *manifest) removeStaleDerivedFiles(root string) error {
+	sortedRuns, err := listFiles(root, sortedRunPattern)
+	if err != nil {
+		return errors.Wrap(err, "failed to list directory")
+	}
+	blooms, err := listFiles(root, bloomPattern)
+	if err != nil {
+		return errors.Wrap(err, "failed to list directory")
+	}
+	files := append(sortedRuns, blooms...)
+	hashDisks := make(map[int]bool)
+	for _, index := range m.HashDisks {
+		hashDisks[int(index)] = true
+	}
+	for _, f := range files {
+		index, err := getDBNumber(f)
+		if err != nil {
+			return err
+		}
+		if hashDisks[index] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(root, f)); err != nil {
+			return errors.Wrapf(err, "failed to remove %s", f)
+		}
+	}
+	return nil
+}
+
+// nextHashDisk returns the index of the next HashDisk to create
+// Indexes of files that are being created or deleted are not reused
+func (m *manifest) nextHashDisk() uint32 {
+	indexes := append([]uint32(nil), m.HashDisks...)
+	files := append(append([]string(nil), m.Pending...), m.Obsolete...)
+	for _, f := range files {
+		if !hashDiskPattern.MatchString(f) {
+			continue
+		}
+		if index, err := getDBNumber(f); err == nil {
+			indexes = append(indexes, uint32(index))
+		}
+	}
+	return nextIndex(indexes)
+}
+
+// nextValuesDisk returns the index of the next ValuesDisk to create
+func (m *manifest) nextValuesDisk() uint32 {
+	return nextIndex(m.ValuesDisks)
+}
+
+func nextIndex(indexes []uint32) uint32 {
+	next := uint32(0)
+	for _, i := range indexes {
+		if i >= next {
+			next = i + 1
+		}
+	}
+	return next
+}
+
+// listDatabaseFiles returns all the HashDisk and ValuesDisk files present in root
+func listDatabaseFiles(root string) ([]string, error) {
+	hashDisks, err := listFiles(root, hashDiskPattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list directory")
+	}
+	valuesDisks, err := listFiles(root, valuesDiskPattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list directory")
+	}
+	return append(hashDisks, valuesDisks...), nil
+}
@@ -0,0 +1,278 @@
+package kvimd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// No manifest yet
+	m, err := loadManifest(dir)
+	require.NoError(t, err)
+	require.Nil(t, m)
+
+	m = &manifest{
+		FormatVersion: formatVersion,
+		KeySize:       20,
+		FileSize:      testFileSize,
+		HashFunction:  hashFunctionMurmur,
+		HashDisks:     []uint32{0, 1},
+		ValuesDisks:   []uint32{3, 4, 7},
+	}
+	err = m.save(dir)
+	require.NoError(t, err)
+	loaded, err := loadManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, m, loaded)
+	require.Equal(t, uint32(2), loaded.nextHashDisk())
+	require.Equal(t, uint32(8), loaded.nextValuesDisk())
+
+	// Indexes of files being created or deleted are not reused
+	m.Pending = []string{createHashDiskPath(5)}
+	require.Equal(t, uint32(6), m.nextHashDisk())
+	m.Obsolete = []string{createHashDiskPath(9)}
+	require.Equal(t, uint32(10), m.nextHashDisk())
+
+	// The temporary file is never left behind
+	_, err = os.Stat(filepath.Join(dir, manifestFile+".tmp"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestManifestOpen(t *testing.T) {
+	setup := func(t *testing.T) (string, *manifest) {
+		dir, err := ioutil.TempDir("", "manifest")
+		require.NoError(t, err)
+		m, err := openManifest(dir, Options{FileSize: testFileSize})
+		require.NoError(t, err)
+		require.Equal(t, defaultKeySize, m.KeySize)
+		m.HashDisks = []uint32{0}
+		m.ValuesDisks = []uint32{0}
+		require.NoError(t, m.save(dir))
+		for _, f := range []string{createHashDiskPath(0), createValuesDiskPath(0)} {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, f), nil, 0644))
+		}
+		return dir, m
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		reopened, err := openManifest(dir, Options{})
+		require.NoError(t, err)
+		require.Equal(t, m, reopened)
+	})
+	t.Run("stray_file", func(t *testing.T) {
+		dir, _ := setup(t)
+		defer os.RemoveAll(dir)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, createValuesDiskPath(1)), nil, 0644))
+		_, err := openManifest(dir, Options{})
+		require.Equal(t, ErrManifest, errors.Cause(err))
+	})
+	t.Run("missing_file", func(t *testing.T) {
+		dir, _ := setup(t)
+		defer os.RemoveAll(dir)
+		require.NoError(t, os.Remove(filepath.Join(dir, createHashDiskPath(0))))
+		_, err := openManifest(dir, Options{})
+		require.Equal(t, ErrManifest, errors.Cause(err))
+	})
+	t.Run("missing_manifest", func(t *testing.T) {
+		// Files without a manifest are migrated as a database created before the manifest (see TestLegacyMigration),
+		// these empty ones can't be
+		dir, _ := setup(t)
+		defer os.RemoveAll(dir)
+		require.NoError(t, os.Remove(filepath.Join(dir, manifestFile)))
+		_, err := openManifest(dir, Options{})
+		require.Equal(t, ErrCorrupted, errors.Cause(err))
+		_, err = os.Stat(filepath.Join(dir, manifestFile))
+		require.True(t, os.IsNotExist(err))
+	})
+	t.Run("incompatible_version", func(t *testing.T) {
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		m.FormatVersion = formatVersion + 1
+		require.NoError(t, m.save(dir))
+		_, err := openManifest(dir, Options{})
+		require.Equal(t, ErrIncompatible, errors.Cause(err))
+	})
+	t.Run("upgrade_version_3", func(t *testing.T) {
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		m.FormatVersion = 3
+		m.Probing = ""
+		require.NoError(t, m.save(dir))
+		reopened, err := openManifest(dir, Options{})
+		require.NoError(t, err)
+		require.Equal(t, formatVersion, reopened.FormatVersion)
+		require.Equal(t, probingLinear, reopened.Probing)
+	})
+	t.Run("upgrade_version_4", func(t *testing.T) {
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		m.FormatVersion = 4
+		m.OffsetSize = 0
+		require.NoError(t, m.save(dir))
+		reopened, err := openManifest(dir, Options{LargeFiles: true})
+		require.NoError(t, err)
+		require.Equal(t, formatVersion, reopened.FormatVersion)
+		require.Equal(t, offsetSize32, reopened.OffsetSize)
+	})
+	t.Run("unknown_offset_size", func(t *testing.T) {
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		m.OffsetSize = 16
+		require.NoError(t, m.save(dir))
+		_, err := openManifest(dir, Options{})
+		require.Equal(t, ErrIncompatible, errors.Cause(err))
+	})
+	t.Run("file_size", func(t *testing.T) {
+		// Files of 4Gb or more need large files
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		_, err := openManifest(dir, Options{FileSize: 5 << 30})
+		require.Equal(t, ErrFileTooBig, err)
+		m.OffsetSize = offsetSize64
+		require.NoError(t, m.save(dir))
+		reopened, err := openManifest(dir, Options{FileSize: 5 << 30})
+		require.NoError(t, err)
+		require.Equal(t, int64(5<<30), reopened.FileSize)
+	})
+	t.Run("unknown_probing", func(t *testing.T) {
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		m.Probing = "cuckoo"
+		require.NoError(t, m.save(dir))
+		_, err := openManifest(dir, Options{})
+		require.Equal(t, ErrIncompatible, errors.Cause(err))
+	})
+	t.Run("hasher", func(t *testing.T) {
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		_, err := openManifest(dir, Options{Hasher: XXH3Hasher{}})
+		require.Equal(t, ErrIncompatible, errors.Cause(err))
+		_, err = openManifest(dir, Options{Hasher: MurmurHasher{}})
+		require.NoError(t, err)
+
+		// A custom hasher must be given again
+		m.HashFunction = "custom"
+		require.NoError(t, m.save(dir))
+		_, err = openManifest(dir, Options{})
+		require.Equal(t, ErrIncompatible, errors.Cause(err))
+		_, err = openManifest(dir, Options{Hasher: customHasher{}})
+		require.NoError(t, err)
+	})
+	t.Run("key_size", func(t *testing.T) {
+		dir, _ := setup(t)
+		defer os.RemoveAll(dir)
+		_, err := openManifest(dir, Options{KeySize: 32})
+		require.Equal(t, ErrKeySize, errors.Cause(err))
+	})
+	t.Run("file_sizes", func(t *testing.T) {
+		dir, _ := setup(t)
+		defer os.RemoveAll(dir)
+		m, err := openManifest(dir, Options{HashDiskSize: 1 << 20, ValuesDiskSize: 1 << 24, HashDiskGrowth: 2})
+		require.NoError(t, err)
+		require.Equal(t, int64(1<<20), m.hashDiskSize())
+		require.Equal(t, int64(1<<24), m.valuesDiskSize())
+
+		// They are persisted
+		m, err = openManifest(dir, Options{})
+		require.NoError(t, err)
+		require.Equal(t, int64(1<<20), m.hashDiskSize())
+		require.Equal(t, int64(1<<24), m.valuesDiskSize())
+		require.Equal(t, float64(2), m.HashDiskGrowth)
+
+		// The HashDisks can be sized from the average size of the values
+		m, err = openManifest(dir, Options{AverageValueSize: 1000})
+		require.NoError(t, err)
+		require.True(t, m.hashDiskSize() < m.valuesDiskSize())
+		n, err := openManifest(dir, Options{AverageValueSize: 100})
+		require.NoError(t, err)
+		require.True(t, n.hashDiskSize() > m.hashDiskSize())
+		_, err = openManifest(dir, Options{AverageValueSize: 1})
+		require.NoError(t, err) // Capped to the max file size
+
+		// FileSize is the size of both
+		m, err = openManifest(dir, Options{FileSize: 1 << 22})
+		require.NoError(t, err)
+		require.Equal(t, int64(1<<22), m.hashDiskSize())
+		require.Equal(t, int64(1<<22), m.valuesDiskSize())
+		_, err = openManifest(dir, Options{ValuesDiskSize: 5 << 30})
+		require.Equal(t, ErrFileTooBig, err)
+
+		// Files can't reach the max file size, which can't be more than 4Gb without large files
+		m, err = openManifest(dir, Options{MaxFileSize: 1 << 23})
+		require.NoError(t, err)
+		require.Equal(t, int64(1<<23), m.maxFileSize(maxFileSize))
+		require.Equal(t, int64(1<<22), m.maxFileSize(1<<22))
+		_, err = openManifest(dir, Options{FileSize: 1 << 23})
+		require.Equal(t, ErrFileTooBig, err)
+		_, err = openManifest(dir, Options{MaxFileSize: 5 << 30})
+		require.Equal(t, ErrFileTooBig, err)
+		m, err = openManifest(dir, Options{AverageValueSize: 1})
+		require.NoError(t, err)
+		require.Equal(t, int64(1<<23-1), m.hashDiskSize())
+	})
+	t.Run("pending", func(t *testing.T) {
+		// Files that were being created when we crashed are removed
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		pending := createHashDiskPath(1)
+		m.Pending = []string{pending}
+		require.NoError(t, m.save(dir))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, pending), nil, 0644))
+
+		reopened, err := openManifest(dir, Options{})
+		require.NoError(t, err)
+		require.Empty(t, reopened.Pending)
+		_, err = os.Stat(filepath.Join(dir, pending))
+		require.True(t, os.IsNotExist(err))
+	})
+	t.Run("obsolete", func(t *testing.T) {
+		// Files that were removed from the manifest but not deleted before we crashed are deleted
+		dir, m := setup(t)
+		defer os.RemoveAll(dir)
+		obsolete := createHashDiskPath(1)
+		m.Obsolete = []string{obsolete}
+		require.NoError(t, m.save(dir))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, obsolete), nil, 0644))
+
+		reopened, err := openManifest(dir, Options{})
+		require.NoError(t, err)
+		require.Empty(t, reopened.Obsolete)
+		_, err = os.Stat(filepath.Join(dir, obsolete))
+		require.True(t, os.IsNotExist(err))
+	})
+	t.Run("stale_derived_files", func(t *testing.T) {
+		// Sorted runs and bloom filters of HashDisks that are not in the manifest are removed
+		dir, _ := setup(t)
+		defer os.RemoveAll(dir)
+		for _, f := range []string{createSortedRunPath(0), createSortedRunPath(1), createBloomPath(0), createBloomPath(1)} {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, f), nil, 0644))
+		}
+		_, err := openManifest(dir, Options{})
+		require.NoError(t, err)
+		runs, err := listFiles(dir, sortedRunPattern)
+		require.NoError(t, err)
+		require.Equal(t, []string{createSortedRunPath(0)}, runs)
+		blooms, err := listFiles(dir, bloomPattern)
+		require.NoError(t, err)
+		require.Equal(t, []string{createBloomPath(0)}, blooms)
+	})
+}
+
+type customHasher struct {
+	IdentityHasher
+}
+
+func (customHasher) Name() string {
+	return "custom"
+}
@@ -0,0 +1,104 @@
+package kvimd
+
+import "time"
+
+const (
+	defaultKeySize      = 16
+	defaultFileSize     = 1 << 30 // 1Gb
+	defaultSyncInterval = time.Second
+	// defaultMaxLargeFileSize is the default Options.MaxFileSize of databases with large files
+	defaultMaxLargeFileSize = 64 << 30 // 64Gb
+)
+
+// Durability is how hard the database tries to persist writes to disk
+type Durability int
+
+const (
+	// DurabilityNone lets the OS write the mmapped files back to disk whenever it wants (and on Close or Sync)
+	DurabilityNone Durability = iota
+	// DurabilityPeriodic flushes all the files to disk every Options.SyncInterval
+	DurabilityPeriodic
+	// DurabilitySync flushes the files to disk on every write. Write only returns once the value is persisted
+	DurabilitySync
+)
+
+// Probing is how the HashDisks resolve collisions
+type Probing int
+
+const (
+	// ProbingLinear is plain linear probing. HashDisks accept keys up to a load factor of 0.8
+	ProbingLinear Probing = iota
+	// ProbingRobinHood is linear probing with Robin Hood insertion: every entry stores its distance to its slot
+	// and keys that are far from their slot take the place of the ones that are close to theirs.
+	// Probe lengths stay short so HashDisks accept keys up to a load factor of 0.95 (but entries are 4 bytes bigger)
+	ProbingRobinHood
+)
+
+// Options are the settings of a kvimd database. The zero value is valid and uses the defaults
+type Options struct {
+	// FileSize is the size (in bytes) of each HashDisk and ValuesDisk file. Default to 1Gb
+	// When reopening a database, it defaults to the size the database was created with. It only applies to new files
+	// It must be smaller than 4Gb unless the database uses LargeFiles
+	FileSize int64
+	// HashDiskSize is the size (in bytes) of each HashDisk file. Default to FileSize (or derived from AverageValueSize)
+	// When reopening a database, it defaults to the size the database was created with. It only applies to new files
+	HashDiskSize int64
+	// ValuesDiskSize is the size (in bytes) of each ValuesDisk file. Default to FileSize
+	// When reopening a database, it defaults to the size the database was created with. It only applies to new files
+	ValuesDiskSize int64
+	// AverageValueSize is the expected average size (in bytes) of the values. If HashDiskSize is not set, it is used to size
+	// the HashDisks so that they are full at the same time as the ValuesDisks (an entry of a HashDisk is much smaller than most values)
+	AverageValueSize int
+	// HashDiskGrowth is by how much each new HashDisk is bigger than the previous one (e.g: 2 doubles the size every rotation),
+	// without going over the max file size. Default to 1 (all the HashDisks have the same size), values smaller than 1 are ignored
+	// When reopening a database, it defaults to the growth the database was created with
+	HashDiskGrowth float64
+	// ValuesDiskGrowth is HashDiskGrowth for the ValuesDisks
+	ValuesDiskGrowth float64
+	// MaxFileSize is the size (in bytes) that files never reach, neither when they grow nor when HashDisks are compacted.
+	// Default to 64Gb with LargeFiles, 4Gb otherwise (it can't be more without LargeFiles)
+	// When reopening a database, it defaults to the max size the database was created with
+	MaxFileSize int64
+	// KeySize is the size (in bytes) of all the keys stored in the database. Default to 16
+	// It is persisted in the database manifest and it is not possible to reopen a database with a different key size
+	KeySize int
+	// Probing is how the HashDisks resolve collisions. Default to ProbingLinear
+	// It is persisted in the database manifest: when reopening a database, the probing it was created with is used
+	Probing Probing
+	// Hasher is the hash function used to find the slot of a key in the HashDisks. Default to MurmurHasher
+	// Its name is persisted in the database manifest: when reopening a database, the hasher it was created with is used
+	// (a custom one must be given again)
+	Hasher Hasher
+	// LargeFiles stores the offsets of the values in the HashDisks as uint64 instead of uint32 so that files can be
+	// bigger than 4Gb (HashDisk entries are 4 bytes bigger). Values themselves are still limited to 4Gb each
+	// It is persisted in the database manifest: when reopening a database, the layout it was created with is used
+	LargeFiles bool
+	// Durability is how writes are persisted to disk. Default to DurabilityNone
+	Durability Durability
+	// SyncInterval is how often the files are flushed to disk with DurabilityPeriodic. Default to 1s
+	SyncInterval time.Duration
+	// WriteAheadLog logs (and fsyncs) every write to an append-only file before applying it. The log is replayed
+	// on open so that writes are never lost, even if the mmapped files were not written back to disk before a crash
+	WriteAheadLog bool
+	// Logger receives the messages of the database (rotations, errors of the background tasks). Default to printing them to stdout
+	Logger Logger
+	// Hooks are called on the events of the database (rotations, recovery of the write-ahead log, corruptions, errors of the background tasks)
+	Hooks Hooks
+}
+
+// withDefaults returns a copy of the options with zero values replaced by the defaults
+func (o Options) withDefaults() Options {
+	if o.FileSize == 0 {
+		o.FileSize = defaultFileSize
+	}
+	if o.KeySize == 0 {
+		o.KeySize = defaultKeySize
+	}
+	if o.SyncInterval == 0 {
+		o.SyncInterval = defaultSyncInterval
+	}
+	if o.Logger == nil {
+		o.Logger = stdoutLogger{}
+	}
+	return o
+}
@@ -12,6 +12,17 @@ var (
 	errUnknownPattern = errors.New("unknow file pattern")
 	hashDiskPattern   = regexp.MustCompile(`^db([0-9]+)\.hashdisk$`)
 	valuesDiskPattern = regexp.MustCompile(`^db([0-9]+)\.valuesdisk$`)
+	sortedRunPattern  = regexp.MustCompile(`^db([0-9]+)\.keyindex$`)
+	bloomPattern      = regexp.MustCompile(`^db([0-9]+)\.bloom$`)
+	// valueTmpPattern matches the temporary files of the ValueWriters (created with valueTmpPrefix)
+	valueTmpPattern = regexp.MustCompile(`^value-[0-9]+\.tmp$`)
+	// migratePattern matches the migrated copies of the files of a database created before the manifest
+	migratePattern = regexp.MustCompile(`^db[0-9]+\.(hashdisk|valuesdisk)\.migrate$`)
+)
+
+const (
+	valueTmpPrefix = "value-*.tmp"
+	bloomExtension = ".bloom"
 )
 
 // listFiles returns all the files that are present in root with the given pattern
@@ -35,18 +46,11 @@ func listFiles(root string, pattern *regexp.Regexp) ([]string, error) {
 }
 
 func getDBNumber(path string) (int, error) {
-	if hashDiskPattern.MatchString(path) {
-		m := hashDiskPattern.FindStringSubmatch(path)
-		if len(m) != 2 {
-			return 0, errors.Errorf("failed to get database index from file=%s (file doesn't match pattern)", path)
+	for _, pattern := range []*regexp.Regexp{hashDiskPattern, valuesDiskPattern, sortedRunPattern, bloomPattern} {
+		if !pattern.MatchString(path) {
+			continue
 		}
-		index, err := strconv.Atoi(m[1])
-		if err != nil {
-			return 0, errors.Wrap(err, "failed to extract database index")
-		}
-		return index, nil
-	} else if valuesDiskPattern.MatchString(path) {
-		m := valuesDiskPattern.FindStringSubmatch(path)
+		m := pattern.FindStringSubmatch(path)
 		if len(m) != 2 {
 			return 0, errors.Errorf("failed to get database index from file=%s (file doesn't match pattern)", path)
 		}
@@ -66,3 +70,11 @@ func createHashDiskPath(index uint32) string {
 func createValuesDiskPath(index uint32) string {
 	return "db" + strconv.Itoa(int(index)) + ".valuesdisk"
 }
+
+func createSortedRunPath(index uint32) string {
+	return "db" + strconv.Itoa(int(index)) + ".keyindex"
+}
+
+func createBloomPath(index uint32) string {
+	return "db" + strconv.Itoa(int(index)) + bloomExtension
+}
@@ -17,6 +17,16 @@ func TestPathsGetDBNumber(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, n, 4545)
 	})
+	t.Run("sorted_run", func(t *testing.T) {
+		n, err := getDBNumber("db12.keyindex")
+		require.NoError(t, err)
+		require.Equal(t, n, 12)
+	})
+	t.Run("bloom", func(t *testing.T) {
+		n, err := getDBNumber("db3.bloom")
+		require.NoError(t, err)
+		require.Equal(t, n, 3)
+	})
 	t.Run("unknown_pattern", func(t *testing.T) {
 		_, err := getDBNumber("random_string.a")
 		require.Equal(t, err, errUnknownPattern)
@@ -36,4 +46,16 @@ func TestPathsCreate(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, n, 53)
 	})
+	t.Run("sorted_run", func(t *testing.T) {
+		s := createSortedRunPath(7)
+		n, err := getDBNumber(s)
+		require.NoError(t, err)
+		require.Equal(t, n, 7)
+	})
+	t.Run("bloom", func(t *testing.T) {
+		s := createBloomPath(9)
+		n, err := getDBNumber(s)
+		require.NoError(t, err)
+		require.Equal(t, n, 9)
+	})
 }
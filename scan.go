@@ -0,0 +1,172 @@
+package kvimd
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Scan calls fn on every key in [start, end) and its value, in increasing key order. A nil start (or end) means
+// there is no lower (or upper) bound. If fn returns an error, the scan stops and the error is returned.
+// key and value are read directly from the mmapped files: they must not be modified and are only valid until fn returns.
+// HashDisks are not ordered, so Scan relies on a sorted copy of the keys of each HashDisk (a sorted run).
+// They are built on the first Scan: for HashDisks that are not written to anymore, they are persisted (db#.keyindex)
+// and reused. The one of the current HashDisk is kept in memory: the keys added to it since the last Scan are merged in it.
+// Keys written while Scan is running may or may not be visited. Close waits for Scan to return.
+func (d *DB) Scan(start, end []byte, fn func(key, value []byte) error) error {
+	if !d.leases.acquire() {
+		return ErrDBClosed
+	}
+	var readErr error
+	defer func() { d.corrupted(readErr) }() // Once the lease is released
+	defer d.leases.release()
+
+	runs, err := d.loadSortedRuns()
+	if err != nil {
+		return errors.Wrap(err, "failed to load sorted runs")
+	}
+
+	// Merge the runs. They are ordered from the oldest to the newest HashDisk
+	positions := make([]int, len(runs))
+	if start != nil {
+		for i, r := range runs {
+			positions[i] = r.Search(start)
+		}
+	}
+	for {
+		var min []byte
+		var fileIndex uint32
+		var fileOffset uint64
+		for i, r := range runs {
+			if positions[i] >= r.Len() {
+				continue
+			}
+			key, index, offset := r.Entry(positions[i])
+			// On equal keys, the newest HashDisk wins (it has the same value anyway)
+			if min == nil || bytes.Compare(key, min) <= 0 {
+				min, fileIndex, fileOffset = key, index, offset
+			}
+		}
+		if min == nil || (end != nil && bytes.Compare(min, end) >= 0) {
+			return nil
+		}
+		for i, r := range runs {
+			if positions[i] < r.Len() {
+				if key, _, _ := r.Entry(positions[i]); bytes.Equal(key, min) {
+					positions[i]++
+				}
+			}
+		}
+
+		var value []byte
+		if value, readErr = d.record(fileIndex, fileOffset); readErr != nil {
+			return readErr
+		}
+		if err := fn(min, value); err != nil {
+			return err
+		}
+	}
+}
+
+// ScanPrefix calls fn on every key starting with prefix and its value, in increasing key order (see Scan)
+func (d *DB) ScanPrefix(prefix []byte, fn func(key, value []byte) error) error {
+	return d.Scan(prefix, prefixEnd(prefix), fn)
+}
+
+// prefixEnd returns the smallest key that is greater than all the keys starting with prefix.
+// Return nil if there is none (the prefix is only 0xff)
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// loadSortedRuns returns the up-to-date sorted runs of all the HashDisks, building them if needed
+func (d *DB) loadSortedRuns() ([]*sortedRun, error) {
+	// HashDisks are only closed after all leases are released so we can keep using them without the lock
+	d.openHashDiskMutex.RLock()
+	hashDisks := append([]*hashDisk(nil), d.openHashDisk...)
+	d.openHashDiskMutex.RUnlock()
+	if len(hashDisks) == 0 {
+		return nil, ErrDBClosed
+	}
+
+	d.sortedRunsMutex.Lock()
+	defer d.sortedRunsMutex.Unlock()
+	runs := make([]*sortedRun, len(hashDisks))
+	for i, hd := range hashDisks {
+		n := hd.Len()
+		r := d.sortedRuns[hd.FileIndex]
+		if r != nil && r.built == n && (r.Persisted() || i == len(hashDisks)-1) {
+			runs[i] = r
+			continue
+		}
+		if i == len(hashDisks)-1 {
+			// Still written to, keep it in memory only. The keys written since the last Scan are merged in it
+			added, tracked := hd.TakeAdded()
+			if r != nil && !r.Persisted() && tracked {
+				r = r.merge(added)
+			} else {
+				d.closeSortedRun(r)
+				hd.TrackAdded()
+				r = buildSortedRun(hd)
+			}
+		} else {
+			// Not written to anymore, we can persist it
+			hd.UntrackAdded()
+			path := filepath.Join(d.RootPath, createSortedRunPath(hd.FileIndex))
+			if r == nil || r.built != n {
+				d.closeSortedRun(r)
+				var err error
+				if r, err = openSortedRun(path, hd); err != nil {
+					return nil, err
+				}
+			}
+			if r == nil {
+				r = buildSortedRun(hd)
+			}
+			if r.built != hd.Len() {
+				// Writes that started before the HashDisk was rotated are still publishing their keys:
+				// use what we have, it is built again (and persisted) on the next Scan
+				d.sortedRuns[hd.FileIndex] = r
+				runs[i] = r
+				continue
+			}
+			if !r.Persisted() {
+				if err := r.save(path); err != nil {
+					return nil, err
+				}
+				var err error
+				if r, err = openSortedRun(path, hd); err != nil {
+					return nil, err
+				}
+				if r == nil {
+					return nil, errors.Errorf("sorted run %s doesn't match its HashDisk", path)
+				}
+			}
+		}
+		d.sortedRuns[hd.FileIndex] = r
+		runs[i] = r
+	}
+	return runs, nil
+}
+
+// closeSortedRun closes r (if not nil), which is replaced by a newer run, once the Scans that might use it returned.
+// The caller must hold sortedRunsMutex
+func (d *DB) closeSortedRun(r *sortedRun) {
+	if r == nil || !r.Persisted() {
+		return
+	}
+	delete(d.sortedRuns, r.FileIndex)
+	d.leases.afterRelease(func() {
+		if err := r.Close(); err != nil {
+			d.backgroundError(errors.Wrap(err, "failed to close sorted run"))
+		}
+	})
+}
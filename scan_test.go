@@ -0,0 +1,244 @@
+package kvimd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Small files so that the keys are spread over multiple HashDisks
+	db, err := NewDB(dir, Options{FileSize: 1 << 20})
+	require.NoError(t, err)
+
+	tests := make(map[string][]byte)
+	write := func(n int) {
+		keys := make([][]byte, n)
+		values := make([][]byte, n)
+		for i := range keys {
+			test := generateKvimdTest()
+			test.Key[0] = byte(i % 4) // 4 "tenants"
+			tests[string(test.Key)] = test.Value
+			keys[i], values[i] = test.Key, test.Value
+		}
+		_, err := db.WriteBatch(keys, values)
+		require.NoError(t, err)
+	}
+	sortedKeys := func() []string {
+		keys := make([]string, 0, len(tests))
+		for key := range tests {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	scan := func(start, end []byte) []string {
+		var keys []string
+		err := db.Scan(start, end, func(key, value []byte) error {
+			require.Equal(t, tests[string(key)], value)
+			keys = append(keys, string(key))
+			return nil
+		})
+		require.NoError(t, err)
+		return keys
+	}
+
+	write(40000)
+	require.True(t, len(db.manifest.HashDisks) > 1)
+	require.Equal(t, sortedKeys(), scan(nil, nil))
+
+	// The runs of the full HashDisks are persisted
+	runs, err := listFiles(dir, sortedRunPattern)
+	require.NoError(t, err)
+	require.Len(t, runs, len(db.manifest.HashDisks)-1)
+
+	// New keys are visible in the next scan
+	write(1000)
+	keys := sortedKeys()
+	require.Equal(t, keys, scan(nil, nil))
+
+	// Ranges
+	start, end := []byte(keys[100]), []byte(keys[20000])
+	require.Equal(t, keys[100:20000], scan(start, end))
+	require.Equal(t, keys[20000:], scan(end, nil))
+	require.Equal(t, keys[:100], scan(nil, start))
+	require.Empty(t, scan(end, start))
+
+	// Prefix
+	var prefixed []string
+	err = db.ScanPrefix([]byte{2}, func(key, value []byte) error {
+		require.Equal(t, byte(2), key[0])
+		prefixed = append(prefixed, string(key))
+		return nil
+	})
+	require.NoError(t, err)
+	var expected []string
+	for _, key := range keys {
+		if key[0] == 2 {
+			expected = append(expected, key)
+		}
+	}
+	require.Equal(t, expected, prefixed)
+
+	// Persisted runs are reused after reopen, and rebuilt if they don't match
+	require.NoError(t, db.Close())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, runs[0]), []byte("garbage"), 0644))
+	db, err = NewDB(dir, Options{})
+	require.NoError(t, err)
+	require.Equal(t, keys, scan(nil, nil))
+	require.NoError(t, db.Close())
+}
+
+func TestScanConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: 1 << 20})
+	require.NoError(t, err)
+
+	tests := make([]kvimdTestCase, 40000)
+	values := make(map[string][]byte, len(tests))
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		values[string(tests[i].Key)] = tests[i].Value
+	}
+	// Writer w writes the keys w, w+4, w+8... written[w] is how many of them are written
+	var written [4]int64
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(tests); i += 4 {
+				if err := db.Write(tests[i].Key, tests[i].Value); err != nil {
+					errs <- err
+					return
+				}
+				atomic.AddInt64(&written[w], 1)
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	scan := func() map[string]bool {
+		seen := make(map[string]bool)
+		var previous []byte
+		err := db.Scan(nil, nil, func(key, value []byte) error {
+			require.True(t, bytes.Compare(previous, key) < 0)
+			require.Equal(t, values[string(key)], value)
+			previous = append(previous[:0], key...)
+			seen[string(key)] = true
+			return nil
+		})
+		require.NoError(t, err)
+		return seen
+	}
+	for scanning := true; scanning; {
+		select {
+		case <-done:
+			scanning = false
+		default:
+		}
+		var n [4]int
+		for w := range n {
+			n[w] = int(atomic.LoadInt64(&written[w]))
+		}
+		seen := scan()
+		for i := range tests {
+			if i/4 < n[i%4] {
+				require.True(t, seen[string(tests[i].Key)], "key %d is missing", i)
+			}
+		}
+	}
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.True(t, len(db.manifest.HashDisks) > 1)
+	require.Len(t, scan(), len(tests))
+
+	// A write to a full HashDisk that started before its rotation counted its key but didn't publish it yet
+	hd := db.openHashDisk[0]
+	persisted := db.sortedRuns[hd.FileIndex]
+	require.True(t, persisted.Persisted())
+	atomic.AddUint32(&hd.totalEntries, 1)
+	require.Len(t, scan(), len(tests))
+	require.False(t, persisted.Persisted())                   // Replaced and closed
+	require.False(t, db.sortedRuns[hd.FileIndex].Persisted()) // The run is incomplete, it is not persisted
+	atomic.AddUint32(&hd.totalEntries, ^uint32(0))
+	require.Len(t, scan(), len(tests))
+	require.True(t, db.sortedRuns[hd.FileIndex].Persisted())
+
+	// The persisted runs have all their keys
+	require.NoError(t, db.Close())
+	db, err = NewDB(dir, Options{})
+	require.NoError(t, err)
+	require.Len(t, scan(), len(tests))
+	require.NoError(t, db.Close())
+}
+
+func TestScanMergeAdded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvimd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, Options{FileSize: testFileSize})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			test := generateKvimdTest()
+			require.NoError(t, db.Write(test.Key, test.Value))
+		}
+	}
+
+	write(1000)
+	runs, err := db.loadSortedRuns()
+	require.NoError(t, err)
+	hd := db.openHashDisk[len(db.openHashDisk)-1]
+	// The keys written since are merged in the run instead of building it again
+	write(1000)
+	updated, err := db.loadSortedRuns()
+	require.NoError(t, err)
+	require.NotEqual(t, runs[len(runs)-1], updated[len(updated)-1])
+	require.Equal(t, buildSortedRun(hd).data, updated[len(updated)-1].data)
+	added, tracked := hd.TakeAdded()
+	require.True(t, tracked)
+	require.Empty(t, added)
+
+	// Keys that are both in the run and added (published while the run was built) are only kept once
+	write(10)
+	r := buildSortedRun(hd)
+	added, _ = hd.TakeAdded()
+	require.Len(t, added, 10*int(r.entrySize))
+	merged := r.merge(added)
+	require.Equal(t, r.data, merged.data)
+	require.Equal(t, hd.Len(), merged.built)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte{1, 3}, prefixEnd([]byte{1, 2}))
+	require.Equal(t, []byte{2}, prefixEnd([]byte{1, 0xff}))
+	require.Nil(t, prefixEnd([]byte{0xff, 0xff}))
+	require.Nil(t, prefixEnd(nil))
+	require.True(t, bytes.Compare([]byte{1, 2, 0xff, 0xff}, prefixEnd([]byte{1, 2})) < 0)
+}
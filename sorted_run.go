@@ -0,0 +1,236 @@
+package kvimd
+
+import (
+	"bytes"
+	"hash/crc32"
+	"os"
+	"sort"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/pkg/errors"
+)
+
+// sortedRunHeaderSize is the size of the header of a sorted run file. It contains:
+//   - [0:4] the number of entries
+//   - [4:8] the crc32c of the entries
+const sortedRunHeaderSize = 8
+
+// sortedRunLocationSize is the size of the location of a value in a sorted run: file index (uint32) and
+// file offset (always uint64, whatever the size of the offsets in the HashDisk)
+const sortedRunLocationSize = 4 + 8
+
+// sortedRun holds all the entries (key, file index, file offset) of a HashDisk sorted by key
+// (whatever the probing of the HashDisk, without the probe distance).
+// Once a HashDisk is not written to anymore, its sorted run is persisted next to it (db#.keyindex)
+// so that it is only built once. It is read-only once built so it is thread-safe
+type sortedRun struct {
+	FileIndex uint32 // Index of the HashDisk it was built from
+	// built is the number of entries of the run. As entries are counted by the HashDisk before they are published,
+	// the run has all the keys of the HashDisk only if it has as many: otherwise it is stale
+	built     uint32
+	keySize   uint32
+	entrySize uint32
+	data      []byte // The sorted entries, either in memory or pointing in m
+	file      *os.File
+	m         mmap.MMap
+}
+
+// buildSortedRun builds the sorted run of h in memory. It is safe to call concurrently with writes to h
+// (keys written during the build may or may not be in the run, if they are not the run is stale)
+func buildSortedRun(h *hashDisk) *sortedRun {
+	r := &sortedRun{
+		FileIndex: h.FileIndex,
+		keySize:   h.keySize,
+		entrySize: h.keySize + sortedRunLocationSize,
+		data:      make([]byte, 0, int(h.Len())*int(h.keySize+sortedRunLocationSize)),
+	}
+	for slot := uint32(0); slot < h.Slots(); slot = batchEnd(h, slot) {
+		h.ScanSlots(slot, batchEnd(h, slot), func(key []byte, fileIndex uint32, fileOffset uint64) {
+			r.data = appendRunEntry(r.data, key, fileIndex, fileOffset)
+		})
+	}
+	sort.Sort(entrySorter{r})
+	r.built = uint32(r.Len())
+	return r
+}
+
+// appendRunEntry appends to data the entry of key, encoded as in a sorted run
+func appendRunEntry(data, key []byte, fileIndex uint32, fileOffset uint64) []byte {
+	var location [sortedRunLocationSize]byte
+	encoding.PutUint32(location[0:4], fileIndex)
+	encoding.PutUint64(location[4:12], fileOffset)
+	return append(append(data, key...), location[:]...)
+}
+
+// merge returns a new run (in memory) with the entries of r and added (entries that are not sorted, as returned
+// by hashDisk.TakeAdded). Keys that are in both are only kept once
+func (r *sortedRun) merge(added []byte) *sortedRun {
+	a := &sortedRun{FileIndex: r.FileIndex, keySize: r.keySize, entrySize: r.entrySize, data: added}
+	sort.Sort(entrySorter{a})
+	merged := &sortedRun{
+		FileIndex: r.FileIndex,
+		keySize:   r.keySize,
+		entrySize: r.entrySize,
+		data:      make([]byte, 0, len(r.data)+len(a.data)),
+	}
+	var last []byte
+	for i, j := 0, 0; i < r.Len() || j < a.Len(); {
+		var entry []byte
+		if j == a.Len() || (i < r.Len() && bytes.Compare(r.key(i), a.key(j)) <= 0) {
+			entry = r.entry(i)
+			i++
+		} else {
+			entry = a.entry(j)
+			j++
+		}
+		if last != nil && bytes.Equal(entry[:r.keySize], last) {
+			continue
+		}
+		merged.data = append(merged.data, entry...)
+		last = entry[:r.keySize]
+	}
+	merged.built = uint32(merged.Len())
+	return merged
+}
+
+// openSortedRun opens the sorted run persisted at path. It returns a nil run if there is none or
+// if it doesn't match h anymore (e.g: it was written before a crash)
+func openSortedRun(path string, h *hashDisk) (*sortedRun, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to get file infos")
+	}
+	built := h.Len()
+	if info.Size() != sortedRunHeaderSize+int64(built)*int64(h.keySize+sortedRunLocationSize) {
+		f.Close()
+		return nil, nil
+	}
+	m, err := mmap.Map(f, mmap.RDONLY, 0)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to mmap file")
+	}
+	data := m[sortedRunHeaderSize:]
+	if encoding.Uint32(m[0:4]) != built || encoding.Uint32(m[4:8]) != crc32.Checksum(data, crcTable) {
+		m.Unmap()
+		f.Close()
+		return nil, nil
+	}
+	return &sortedRun{
+		FileIndex: h.FileIndex,
+		built:     built,
+		keySize:   h.keySize,
+		entrySize: h.keySize + sortedRunLocationSize,
+		data:      data,
+		file:      f,
+		m:         m,
+	}, nil
+}
+
+// save atomically writes the run to path (write to a temporary file then rename)
+func (r *sortedRun) save(path string) error {
+	header := make([]byte, sortedRunHeaderSize)
+	encoding.PutUint32(header[0:4], uint32(r.Len()))
+	encoding.PutUint32(header[4:8], crc32.Checksum(r.data, crcTable))
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create sorted run")
+	}
+	_, err1 := f.Write(header)
+	_, err2 := f.Write(r.data)
+	err3 := f.Sync()
+	err4 := f.Close()
+	if err := firstError(err1, err2, err3, err4); err != nil {
+		return errors.Wrap(err, "failed to write sorted run")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrap(err, "failed to replace sorted run")
+	}
+	return nil
+}
+
+// Persisted returns whether the run is backed by its file
+func (r *sortedRun) Persisted() bool {
+	return r.m != nil
+}
+
+// Len returns the number of entries of the run
+func (r *sortedRun) Len() int {
+	return len(r.data) / int(r.entrySize)
+}
+
+// Entry returns the i-th smallest key of the run and the location of its value
+func (r *sortedRun) Entry(i int) (key []byte, fileIndex uint32, fileOffset uint64) {
+	entry := r.entry(i)
+	return entry[:r.keySize], encoding.Uint32(entry[r.keySize : r.keySize+4]), encoding.Uint64(entry[r.keySize+4:])
+}
+
+// entry returns the encoded i-th entry of the run
+func (r *sortedRun) entry(i int) []byte {
+	offset := i * int(r.entrySize)
+	return r.data[offset : offset+int(r.entrySize)]
+}
+
+// key returns the i-th smallest key of the run
+func (r *sortedRun) key(i int) []byte {
+	offset := i * int(r.entrySize)
+	return r.data[offset : offset+int(r.keySize)]
+}
+
+// Search returns the position of the first key greater or equal to key
+func (r *sortedRun) Search(key []byte) int {
+	return sort.Search(r.Len(), func(i int) bool {
+		k, _, _ := r.Entry(i)
+		return bytes.Compare(k, key) >= 0
+	})
+}
+
+// Close the run. It is not safe to call any other method after it
+func (r *sortedRun) Close() error {
+	if r.m == nil {
+		return nil
+	}
+	err1 := r.m.Unmap()
+	err2 := r.file.Close()
+	return firstError(err1, err2)
+}
+
+// entrySorter sorts the entries of a run (that is being built) by key
+type entrySorter struct {
+	r *sortedRun
+}
+
+func (s entrySorter) Len() int {
+	return s.r.Len()
+}
+
+func (s entrySorter) Less(i, j int) bool {
+	ki, _, _ := s.r.Entry(i)
+	kj, _, _ := s.r.Entry(j)
+	return bytes.Compare(ki, kj) < 0
+}
+
+func (s entrySorter) Swap(i, j int) {
+	size := int(s.r.entrySize)
+	a := s.r.data[i*size : (i+1)*size]
+	b := s.r.data[j*size : (j+1)*size]
+	var tmp [256]byte
+	if size > len(tmp) {
+		t := make([]byte, size)
+		copy(t, a)
+		copy(a, b)
+		copy(b, t)
+		return
+	}
+	copy(tmp[:size], a)
+	copy(a, b)
+	copy(b, tmp[:size])
+}
@@ -1,5 +1,25 @@
 package kvimd
 
+import (
+	"encoding/binary"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// nativeEndian is the byte order of the machine. Atomic operations on mmapped files use it so that
+// the bytes in the file are the same as with encoding
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
 func firstError(errs ...error) error {
 	for _, err := range errs {
 		if err != nil {
@@ -8,3 +28,43 @@ func firstError(errs ...error) error {
 	}
 	return nil
 }
+
+// uvarintSize returns the number of bytes needed to encode x as an uvarint
+func uvarintSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+// syncDir flushes to disk the changes made to the entries of a directory (file creations, renames, ...)
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open directory")
+	}
+	err1 := d.Sync()
+	err2 := d.Close()
+	return firstError(err1, err2)
+}
+
+// wordAt returns a pointer to the 4 bytes of b at offset, for atomic operations. They must be 4-byte aligned
+func wordAt(b []byte, offset uint64) *uint32 {
+	return (*uint32)(unsafe.Pointer(&b[offset]))
+}
+
+// atomicLoadUint32 atomically reads the uint32 at offset in b (encoded with encoding)
+func atomicLoadUint32(b []byte, offset uint64) uint32 {
+	var buf [4]byte
+	nativeEndian.PutUint32(buf[:], atomic.LoadUint32(wordAt(b, offset)))
+	return encoding.Uint32(buf[:])
+}
+
+// atomicStoreUint32 atomically writes v at offset in b (encoded with encoding)
+func atomicStoreUint32(b []byte, offset uint64, v uint32) {
+	var buf [4]byte
+	encoding.PutUint32(buf[:], v)
+	atomic.StoreUint32(wordAt(b, offset), nativeEndian.Uint32(buf[:]))
+}
@@ -0,0 +1,104 @@
+package kvimd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// valueWriterMemorySize is the size after which a ValueWriter stops buffering in memory and moves to a temporary file
+const valueWriterMemorySize = 4 << 20 // 4Mb
+
+var errValueWriterDone = errors.New("value writer is already closed or aborted")
+
+// ValueWriter streams a value which size is not known upfront in the database.
+// The value is buffered (in memory, then in a temporary file in the database directory once it gets big)
+// and is only written to the database on Close. Abort discards it.
+// It is not thread-safe
+type ValueWriter struct {
+	db   *DB
+	key  []byte
+	buf  bytes.Buffer
+	file *os.File // Temporary file, once the value doesn't fit in memory anymore
+	size int
+	done bool
+}
+
+// Create returns a writer for the value of key. Nothing is written to the database until Close is called.
+// As for Write, if key already exists in the database, the value is discarded
+func (d *DB) Create(key []byte) (*ValueWriter, error) {
+	if len(key) != d.keySize {
+		return nil, ErrInvalidKey
+	}
+	if atomic.LoadUint32(&d.closed) > 0 {
+		return nil, ErrDBClosed
+	}
+	return &ValueWriter{
+		db:  d,
+		key: append([]byte(nil), key...),
+	}, nil
+}
+
+// Write appends p to the value
+func (w *ValueWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errValueWriterDone
+	}
+	if w.file == nil && w.buf.Len()+len(p) > valueWriterMemorySize {
+		// Too big to keep in memory, move what we have to a temporary file
+		f, err := ioutil.TempFile(w.db.RootPath, valueTmpPrefix)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to create temporary file")
+		}
+		w.file = f
+		if _, err := w.buf.WriteTo(f); err != nil {
+			return 0, errors.Wrap(err, "failed to write to temporary file")
+		}
+		w.buf = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if w.file != nil {
+		n, err = w.file.Write(p)
+	} else {
+		n, err = w.buf.Write(p)
+	}
+	w.size += n
+	return n, err
+}
+
+// Close writes the value to the database. Once it returns (without error), the value can be read.
+// It is not safe to call Write after Close
+func (w *ValueWriter) Close() error {
+	if w.done {
+		return errValueWriterDone
+	}
+	defer w.Abort() // Clean up
+	var r io.ReadSeeker
+	if w.file != nil {
+		r = w.file
+	} else {
+		r = bytes.NewReader(w.buf.Bytes())
+	}
+	return w.db.writeFrom(w.key, r, w.size)
+}
+
+// Abort discards the value, nothing is written to the database. It is fine to call it after Close
+func (w *ValueWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.buf = bytes.Buffer{}
+	if w.file != nil {
+		err1 := w.file.Close()
+		err2 := os.Remove(w.file.Name())
+		return firstError(err1, err2)
+	}
+	return nil
+}
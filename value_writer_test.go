@@ -0,0 +1,104 @@
+package kvimd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueWriter(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "kvimd")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		db, err := NewDB(dir, Options{FileSize: testFileSize, WriteAheadLog: wal})
+		require.NoError(t, err)
+
+		// Small value, kept in memory
+		small := generateKvimdTest()
+		w, err := db.Create(small.Key)
+		require.NoError(t, err)
+		half := len(small.Value) / 2
+		_, err = w.Write(small.Value[:half])
+		require.NoError(t, err)
+		_, err = w.Write(small.Value[half:])
+		require.NoError(t, err)
+		_, err = db.Read(small.Key)
+		require.Equal(t, ErrKeyNotFound, err) // Nothing is written before Close
+		require.NoError(t, w.Close())
+		value, err := db.Read(small.Key)
+		require.NoError(t, err)
+		require.Equal(t, small.Value, value)
+		_, err = w.Write(small.Value)
+		require.Error(t, err)
+		require.Error(t, w.Close())
+
+		// Big value, spills to a temporary file
+		key := generateKvimdTest().Key
+		big := make([]byte, 2*valueWriterMemorySize+123)
+		randbo.Read(big)
+		w, err = db.Create(key)
+		require.NoError(t, err)
+		for i := 0; i < len(big); i += 1 << 20 {
+			end := i + 1<<20
+			if end > len(big) {
+				end = len(big)
+			}
+			_, err = w.Write(big[i:end])
+			require.NoError(t, err)
+		}
+		tmpFiles, err := listFiles(dir, valueTmpPattern)
+		require.NoError(t, err)
+		require.Len(t, tmpFiles, 1)
+		require.NoError(t, w.Close())
+		tmpFiles, err = listFiles(dir, valueTmpPattern)
+		require.NoError(t, err)
+		require.Empty(t, tmpFiles)
+		value, err = db.Read(key)
+		require.NoError(t, err)
+		require.Equal(t, big, value)
+
+		// Abort discards the value
+		aborted := generateKvimdTest()
+		w, err = db.Create(aborted.Key)
+		require.NoError(t, err)
+		_, err = w.Write(aborted.Value)
+		require.NoError(t, err)
+		require.NoError(t, w.Abort())
+		require.NoError(t, w.Abort())
+		_, err = db.Read(aborted.Key)
+		require.Equal(t, ErrKeyNotFound, err)
+
+		// Existing keys are not overwritten
+		w, err = db.Create(small.Key)
+		require.NoError(t, err)
+		_, err = w.Write([]byte("other"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		value, err = db.Read(small.Key)
+		require.NoError(t, err)
+		require.Equal(t, small.Value, value)
+
+		_, err = db.Create([]byte("short"))
+		require.Equal(t, ErrInvalidKey, err)
+
+		// Leftover temporary files are removed on open
+		w, err = db.Create(generateKvimdTest().Key)
+		require.NoError(t, err)
+		_, err = w.Write(big)
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		db, err = NewDB(dir, Options{WriteAheadLog: wal})
+		require.NoError(t, err)
+		tmpFiles, err = listFiles(dir, valueTmpPattern)
+		require.NoError(t, err)
+		require.Empty(t, tmpFiles)
+		value, err = db.Read(key)
+		require.NoError(t, err)
+		require.Equal(t, big, value)
+		require.NoError(t, db.Close())
+	}
+}
@@ -2,29 +2,57 @@ package kvimd
 
 import (
 	"encoding/binary"
+	"hash/crc32"
+	"io"
 	"math"
 	"os"
+	"sync"
 	"sync/atomic"
 
 	"github.com/edsrzf/mmap-go"
 	"github.com/pkg/errors"
 )
 
+const (
+	// valuesDiskHeaderSize is the size of the header at the beginning of each file. It contains:
+	//   - [0:8] the high-water mark: no byte at or after it has ever been written.
+	//     Files smaller than 4Gb used to only store it in [0:4], [4:8] was unused (always 0) so it reads the same
+	valuesDiskHeaderSize = 8
+	// valuesDiskReserveSize is by how much we move the high-water mark every time we cross it.
+	// On a crash, this is the most space we can waste
+	valuesDiskReserveSize = 1 << 20 // 1Mb
+	// valuesDiskChecksumSize is the size of the CRC32C that follows every value
+	valuesDiskChecksumSize = 4
+	// maxValueSize is the size from which a value can't be stored (its length is encoded as an uint32)
+	maxValueSize = math.MaxUint32
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // valuesDisk is a file-backed structure where we write the values of the keys
 // It returns the offset at witch the object was written (it's basically a log file)
 // It is thread-safe
-// Possible improvements:
-//   - Do a dicotomy to know what offset to restart on (or read length). This is bc if we crash loop, we will create A LOT of (large) files
+// To be able to resume appending after a crash (concurrent writers can leave holes so we can't just scan the file),
+// we persist in the header a high-water mark that is always moved (and flushed to disk) before any write goes past it.
+// On a clean Close, the high-water mark is set to the exact end of the data.
 type valuesDisk struct {
+	// 64-bit words used with atomic methods need to be first to be aligned on 32-bit platforms
+	index    uint64 // Current index of the write pointer
+	reserved uint64 // In-memory copy of the high-water mark, need to be used with atomic methods
+
 	FileIndex uint32
-	MaxSize   uint32
+	MaxSize   uint64
 
-	file  *os.File
-	index uint32 // Current index of the write pointer
-	m     mmap.MMap
+	file *os.File
+	// reserveMutex must be held to move the high-water mark
+	reserveMutex sync.Mutex
+	m            mmap.MMap
+	// header maps the first page of the file (the same memory as the beginning of m), so that the high-water mark
+	// can be flushed without flushing the whole file
+	header mmap.MMap
 }
 
-func newValuesDisk(path string, size, fileIndex uint32) (*valuesDisk, error) {
+func newValuesDisk(path string, size int64, fileIndex uint32) (*valuesDisk, error) {
 	// Open or create the file
 	f, err := os.OpenFile(path, os.O_RDWR, 0755)
 	if os.IsNotExist(err) {
@@ -33,7 +61,7 @@ func newValuesDisk(path string, size, fileIndex uint32) (*valuesDisk, error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to create file")
 		}
-		err = f.Truncate(int64(size))
+		err = f.Truncate(size)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to resize file")
 		}
@@ -46,7 +74,11 @@ func newValuesDisk(path string, size, fileIndex uint32) (*valuesDisk, error) {
 		f.Close()
 		return nil, errors.Wrap(err, "failed to get file infos")
 	}
-	size = uint32(info.Size())
+	size = info.Size()
+	if size <= valuesDiskHeaderSize {
+		f.Close()
+		return nil, ErrCorrupted
+	}
 
 	// Mmap the file
 	m, err := mmap.Map(f, mmap.RDWR, 0)
@@ -55,36 +87,38 @@ func newValuesDisk(path string, size, fileIndex uint32) (*valuesDisk, error) {
 		return nil, errors.Wrap(err, "failed to mmap file")
 	}
 
-	// Now we will try to reset index to where we can start to append again
-	var index uint32
-	for index < size {
-		valueSize, varintSize := binary.Uvarint(m[index : index+binary.MaxVarintLen32])
-		if valueSize == 0 {
-			// We don't encode a size anymore, we can start appending now
-			break
-		}
-		if valueSize == math.MaxUint32 { // This is the zero value
-			index += uint32(varintSize) // Only need to skip the varint
-		} else {
-			index += uint32(varintSize) + uint32(valueSize)
-		}
+	// Now we restart appending at the high-water mark, everything after it is guaranteed to be unused
+	index := encoding.Uint64(m[0:8])
+	if index == 0 { // New file
+		index = valuesDiskHeaderSize
+		encoding.PutUint64(m[0:8], index)
 	}
-	if index >= size { // This should not happen
+	if index < valuesDiskHeaderSize || index > uint64(size) {
+		m.Unmap()
+		f.Close()
 		return nil, ErrCorrupted
 	}
+	header, err := mmap.MapRegion(f, valuesDiskHeaderSize, mmap.RDWR, 0, 0)
+	if err != nil {
+		m.Unmap()
+		f.Close()
+		return nil, errors.Wrap(err, "failed to mmap header")
+	}
 
 	return &valuesDisk{
 		FileIndex: fileIndex,
-		MaxSize:   size,
+		MaxSize:   uint64(size),
 		file:      f,
 		index:     index,
+		reserved:  index,
 		m:         m,
+		header:    header,
 	}, nil
 }
 
 // Load returns the ratio of currently used space vs total available
 func (v *valuesDisk) Load() float64 {
-	index := atomic.LoadUint32(&v.index)
+	index := atomic.LoadUint64(&v.index)
 	load := float64(index) / float64(v.MaxSize)
 	return load
 }
@@ -92,53 +126,213 @@ func (v *valuesDisk) Load() float64 {
 // Set a new value on the valuesDisk DB
 // Special case to encode a null value: the length will be == to math.MaxUint32
 // This will enable us to treat zero-size as the end of the file (and easily check corruption)
-func (v *valuesDisk) Set(value []byte) (uint32, error) {
-	length := make([]byte, binary.MaxVarintLen32)
-	valueLength := uint64(len(value))
-	if len(value) == 0 {
-		valueLength = uint64(math.MaxUint32)
+// The value is followed by the CRC32C of the length and the value
+func (v *valuesDisk) Set(value []byte) (uint64, error) {
+	if uint64(len(value)) >= maxValueSize {
+		return 0, ErrValueTooBig
+	}
+	size := recordSize(len(value))
+	if size >= v.MaxSize {
+		return 0, ErrNoSpace
 	}
+	index, err := v.allocate(size)
+	if err != nil {
+		return 0, err
+	}
+	putRecord(v.m[index:index+size], value)
+	return index, nil
+}
 
-	n := binary.PutUvarint(length, valueLength)
-	length = length[:n]
+// SetBatch sets multiple values, reserving the space for all of them at once.
+// Either all the values are written or none (if there is not enough space)
+func (v *valuesDisk) SetBatch(values [][]byte) ([]uint64, error) {
+	var total uint64
+	for _, value := range values {
+		if uint64(len(value)) >= maxValueSize {
+			return nil, ErrValueTooBig
+		}
+		total += recordSize(len(value))
+	}
+	if total >= v.MaxSize {
+		return nil, ErrNoSpace
+	}
+	index, err := v.allocate(total)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, len(values))
+	for i, value := range values {
+		size := recordSize(len(value))
+		putRecord(v.m[index:index+size], value)
+		offsets[i] = index
+		index += size
+	}
+	return offsets, nil
+}
 
-	addedSize := len(length) + len(value)
-	newIndex := atomic.AddUint32(&v.index, uint32(addedSize))
-	if newIndex >= v.MaxSize {
-		// We cannot add a negative uint32 and there is no SubUint32 method so we leave it as is
+// allocate reserves size bytes in the file and returns the offset of the reserved space
+func (v *valuesDisk) allocate(size uint64) (uint64, error) {
+	newIndex := atomic.AddUint64(&v.index, size)
+	if newIndex >= v.MaxSize || newIndex < size {
+		// We cannot add a negative uint64 and there is no SubUint64 method so we leave it as is
 		return 0, ErrNoSpace // We will need to recreate a file
 	}
-	index := int64(newIndex) - int64(addedSize) // This is the address reserved to us
-	copy(v.m[index:index+int64(len(length))], length)
-	copy(v.m[index+int64(len(length)):index+int64(len(length)+len(value))], value)
-	return uint32(index), nil
+	if newIndex > atomic.LoadUint64(&v.reserved) {
+		if err := v.reserve(newIndex); err != nil {
+			return 0, err // The space stays allocated but nothing references it
+		}
+	}
+	return newIndex - size, nil // This is the address reserved to us
+}
+
+// SetFrom sets a value of size bytes read from r. If r fails, the space stays allocated but nothing references it
+func (v *valuesDisk) SetFrom(r io.Reader, size int) (uint64, error) {
+	if uint64(size) >= maxValueSize {
+		return 0, ErrValueTooBig
+	}
+	if uint64(size) >= v.MaxSize {
+		return 0, ErrNoSpace
+	}
+	total := recordSize(size)
+	index, err := v.allocate(total)
+	if err != nil {
+		return 0, err
+	}
+	record := v.m[index : index+total]
+	n := binary.PutUvarint(record, encodedLength(size))
+	if _, err := io.ReadFull(r, record[n:n+size]); err != nil {
+		return 0, err
+	}
+	putChecksum(record, n+size)
+	return index, nil
+}
+
+// encodedLength returns the length that is encoded before a value of size valueSize
+func encodedLength(valueSize int) uint64 {
+	if valueSize == 0 {
+		return uint64(math.MaxUint32)
+	}
+	return uint64(valueSize)
+}
+
+// recordSize returns how many bytes are needed to store a value of size valueSize
+func recordSize(valueSize int) uint64 {
+	return uint64(uvarintSize(encodedLength(valueSize)) + valueSize + valuesDiskChecksumSize)
+}
+
+// putRecord encodes value in record, which must be of size recordSize(len(value))
+func putRecord(record, value []byte) {
+	n := binary.PutUvarint(record, encodedLength(len(value)))
+	n += copy(record[n:], value)
+	putChecksum(record, n)
+}
+
+// putChecksum writes after the first n bytes of record their checksum
+func putChecksum(record []byte, n int) {
+	checksum := crc32.Checksum(record[:n], crcTable)
+	encoding.PutUint32(record[n:], checksum)
+}
+
+// reserve moves the high-water mark so that it is at least at index.
+// It is flushed to disk before anyone can write past the previous one: otherwise after a power failure,
+// the file could be reopened with a high-water mark before values that are referenced and we would overwrite them
+func (v *valuesDisk) reserve(index uint64) error {
+	v.reserveMutex.Lock()
+	defer v.reserveMutex.Unlock()
+	reserved := v.reserved
+	if index <= reserved {
+		return nil // Someone else already moved it
+	}
+	for reserved < index {
+		reserved += valuesDiskReserveSize
+	}
+	if reserved > v.MaxSize {
+		reserved = v.MaxSize
+	}
+	encoding.PutUint64(v.header[0:8], reserved)
+	if err := v.header.Flush(); err != nil {
+		return errors.Wrap(err, "failed to flush the high-water mark")
+	}
+	atomic.StoreUint64(&v.reserved, reserved)
+	return nil
 }
 
 // Get a value from offset. No check is made that you are querying the correct offset
+// but if the record at offset doesn't match its checksum, a *CorruptedError is returned
 // Special case to encode a null value: the length will be == to binary.MaxVarintLen32
 // This will enable us to treat zero-size as the end of the file (and easily check corruption)
-func (v *valuesDisk) Get(offset uint32) ([]byte, error) {
+func (v *valuesDisk) Get(offset uint64) ([]byte, error) {
+	value, err := v.record(offset)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, len(value))
+	copy(ret, value)
+	return ret, nil
+}
+
+// record returns the value stored at offset after verifying its checksum.
+// The returned slice points directly into the mmap and must not be used after Close
+func (v *valuesDisk) record(offset uint64) ([]byte, error) {
+	start, end, err := v.bounds(offset)
+	if err != nil {
+		return nil, err
+	}
+	checksum := crc32.Checksum(v.m[offset:end], crcTable)
+	if checksum != encoding.Uint32(v.m[end:end+valuesDiskChecksumSize]) {
+		return nil, &CorruptedError{FileIndex: v.FileIndex, FileOffset: offset}
+	}
+	return v.m[start:end], nil
+}
+
+// Size returns the size of the value stored at offset without reading it (so its checksum is not verified)
+func (v *valuesDisk) Size(offset uint64) (int, error) {
+	start, end, err := v.bounds(offset)
+	if err != nil {
+		return 0, err
+	}
+	return int(end - start), nil
+}
+
+// bounds decodes the length of the record at offset and returns where its value starts and ends
+func (v *valuesDisk) bounds(offset uint64) (start, end uint64, err error) {
 	if offset >= v.MaxSize {
-		return nil, ErrNoSpace
+		return 0, 0, ErrNoSpace
+	}
+	end = offset + binary.MaxVarintLen32
+	if end > v.MaxSize {
+		end = v.MaxSize
+	}
+	valueSize, varintSize := binary.Uvarint(v.m[offset:end])
+	if varintSize <= 0 || valueSize == 0 {
+		return 0, 0, &CorruptedError{FileIndex: v.FileIndex, FileOffset: offset}
 	}
-	offsetInt := int(offset)
-	valueSize, varintSize := binary.Uvarint(v.m[offset : offset+binary.MaxVarintLen32])
 	if valueSize == math.MaxUint32 {
-		// Special case for 0-value
-		ret := make([]byte, 0)
-		return ret, nil
+		valueSize = 0 // Special case for 0-value
 	}
+	start = offset + uint64(varintSize)
+	end = start + valueSize
+	if end+valuesDiskChecksumSize > v.MaxSize {
+		return 0, 0, &CorruptedError{FileIndex: v.FileIndex, FileOffset: offset}
+	}
+	return start, end, nil
+}
 
-	ret := make([]byte, valueSize)
-	copy(ret, v.m[offsetInt+varintSize:offsetInt+varintSize+int(valueSize)])
-
-	return ret, nil
+// Sync flushes all the values written so far to disk
+func (v *valuesDisk) Sync() error {
+	return v.m.Flush()
 }
 
 // Close flushes all the data back to disk.
 // It is not safe anymore to call any Get/Set after it has been closed
 func (v *valuesDisk) Close() error {
-	err1 := v.m.Unmap() // Flush mmap to the file
-	err2 := v.file.Close()
-	return firstError(err1, err2)
+	// We know exactly where the data stops, no need to waste the rest of the reserved space on reopen
+	index := atomic.LoadUint64(&v.index)
+	if index < v.MaxSize {
+		encoding.PutUint64(v.header[0:8], index)
+	}
+	err1 := v.header.Unmap()
+	err2 := v.m.Unmap() // Flush mmap to the file
+	err3 := v.file.Close()
+	return firstError(err1, err2, err3)
 }
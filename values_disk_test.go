@@ -6,8 +6,10 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -33,7 +35,7 @@ func TestValuesDiskSetGet(t *testing.T) {
 	}
 	tests[55] = []byte{} // I want to explicitly test a 0-length value
 
-	offsets := make([]uint32, len(tests))
+	offsets := make([]uint64, len(tests))
 	for i, test := range tests {
 		o, err := v.Set(test)
 		require.NoError(t, err)
@@ -47,6 +49,38 @@ func TestValuesDiskSetGet(t *testing.T) {
 	}
 }
 
+func TestValuesDiskSetBatch(t *testing.T) {
+	// Create DB
+	dir, err := ioutil.TempDir("", "valuesdisk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.valuesdisk")
+
+	v, err := newValuesDisk(path, 1<<20, 0)
+	require.NoError(t, err)
+	defer v.Close()
+
+	tests := make([][]byte, 100)
+	for i := range tests {
+		tests[i] = make([]byte, rand.Intn(2000))
+		randbo.Read(tests[i])
+	}
+	tests[55] = []byte{}
+	offsets, err := v.SetBatch(tests)
+	require.NoError(t, err)
+	for i, test := range tests {
+		val, err := v.Get(offsets[i])
+		require.NoError(t, err)
+		require.Equal(t, test, val)
+	}
+
+	// A batch that doesn't fit is not written at all
+	index := v.index
+	_, err = v.SetBatch([][]byte{make([]byte, 1<<19), make([]byte, 1<<19)})
+	require.Equal(t, ErrNoSpace, err)
+	require.Equal(t, index, v.index)
+}
+
 func TestValuesDiskOpenClose(t *testing.T) {
 	// Correctly check that we recover the data after closing/opening DB
 	// Create DB
@@ -69,7 +103,7 @@ func TestValuesDiskOpenClose(t *testing.T) {
 	}
 	tests[55] = []byte{} // I want to explicitly test a 0-length value
 
-	offsets := make([]uint32, len(tests))
+	offsets := make([]uint64, len(tests))
 	for i, test := range tests {
 		o, err := v.Set(test)
 		require.NoError(t, err)
@@ -99,6 +133,154 @@ func TestValuesDiskOpenClose(t *testing.T) {
 	}
 }
 
+func TestValuesDiskLarge(t *testing.T) {
+	// Test that values can be written after 4Gb in a large file (sparse, so it doesn't use the space)
+	dir, err := ioutil.TempDir("", "valuesdisk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.valuesdisk")
+
+	v, err := newValuesDisk(path, 5<<30, 0)
+	require.NoError(t, err)
+	v.index = 1 << 32
+	value := []byte("after 4Gb")
+	offset, err := v.Set(value)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1<<32), offset)
+	require.NoError(t, v.Close())
+
+	// The high-water mark is after 4Gb too
+	v, err = newValuesDisk(path, 5<<30, 0)
+	require.NoError(t, err)
+	defer v.Close()
+	require.Equal(t, offset+recordSize(len(value)), v.index)
+	val, err := v.Get(offset)
+	require.NoError(t, err)
+	require.Equal(t, value, val)
+}
+
+func TestValuesDiskResume(t *testing.T) {
+	// Check that we resume appending where we stopped, after a clean close and after a crash
+	dir, err := ioutil.TempDir("", "valuesdisk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.valuesdisk")
+	crashPath := filepath.Join(dir, "crash.valuesdisk")
+
+	v, err := newValuesDisk(path, testFileSize, 0)
+	require.NoError(t, err)
+	values := make([][]byte, 100)
+	offsets := make([]uint64, len(values))
+	for i := range values {
+		values[i] = make([]byte, 1+rand.Intn(2000))
+		randbo.Read(values[i])
+		offsets[i], err = v.Set(values[i])
+		require.NoError(t, err)
+	}
+	end := v.index
+
+	// The mmap is shared so copying the file now gives what would be on disk if we crashed
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(crashPath, content, 0644)
+	require.NoError(t, err)
+	err = v.Close()
+	require.NoError(t, err)
+
+	check := func(t *testing.T, v *valuesDisk) {
+		// Appending doesn't override what was written before
+		newValue := []byte("after reopen")
+		o, err := v.Set(newValue)
+		require.NoError(t, err)
+		val, err := v.Get(o)
+		require.NoError(t, err)
+		require.Equal(t, newValue, val)
+		for i, value := range values {
+			val, err := v.Get(offsets[i])
+			require.NoError(t, err)
+			require.Equal(t, value, val)
+		}
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		v, err := newValuesDisk(path, testFileSize, 0)
+		require.NoError(t, err)
+		defer v.Close()
+		require.Equal(t, end, v.index)
+		check(t, v)
+	})
+	t.Run("crash", func(t *testing.T) {
+		v, err := newValuesDisk(crashPath, testFileSize, 0)
+		require.NoError(t, err)
+		defer v.Close()
+		require.True(t, v.index >= end)
+		require.True(t, v.index <= end+valuesDiskReserveSize)
+		check(t, v)
+	})
+}
+
+func TestValuesDiskReserve(t *testing.T) {
+	// The high-water mark is written in the header mapping (which is flushed on its own) before any record past it
+	dir, err := ioutil.TempDir("", "valuesdisk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.valuesdisk")
+
+	v, err := newValuesDisk(path, 4*valuesDiskReserveSize, 0)
+	require.NoError(t, err)
+	value := make([]byte, 100000)
+	for {
+		offset, err := v.Set(value)
+		if err == ErrNoSpace {
+			break
+		}
+		require.NoError(t, err)
+		mark := encoding.Uint64(v.header[0:8])
+		require.Equal(t, atomic.LoadUint64(&v.reserved), mark)
+		require.True(t, offset+recordSize(len(value)) <= mark)
+	}
+	require.Equal(t, v.MaxSize, encoding.Uint64(v.m[0:8]))
+	require.NoError(t, v.Close())
+}
+
+func TestValuesDiskCorruption(t *testing.T) {
+	// Check that we detect a value that was modified on disk
+	dir, err := ioutil.TempDir("", "valuesdisk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.valuesdisk")
+
+	v, err := newValuesDisk(path, testFileSize, 3)
+	require.NoError(t, err)
+	defer v.Close()
+
+	value := []byte("immutable value")
+	cases := map[string]int{
+		"length":   0,
+		"value":    1 + len(value)/2,
+		"checksum": 1 + len(value),
+	}
+	for name, position := range cases {
+		t.Run(name, func(t *testing.T) {
+			offset, err := v.Set(value)
+			require.NoError(t, err)
+			_, err = v.Get(offset)
+			require.NoError(t, err)
+
+			v.m[int(offset)+position] ^= 0x01 // Flip a bit
+			_, err = v.Get(offset)
+			require.Equal(t, ErrCorrupted, errors.Cause(err))
+			corrupted, ok := err.(*CorruptedError)
+			require.True(t, ok)
+			require.Equal(t, uint32(3), corrupted.FileIndex)
+			require.Equal(t, offset, corrupted.FileOffset)
+		})
+	}
+	// Reading where nothing was written is also detected
+	_, err = v.Get(v.index + 100)
+	require.Equal(t, ErrCorrupted, errors.Cause(err))
+}
+
 func TestValuesDiskLoad(t *testing.T) {
 	// Create DB
 	dir, err := ioutil.TempDir("", "valuesdisk")
@@ -134,11 +316,11 @@ func BenchmarkValuesDiskSet(b *testing.B) {
 	size := benchFileSize
 	// Make sure that we don't want to write more that what we can.
 	// If we do, then increase the DB size
-	neededSize := int(float64(b.N*(valueSize+binary.MaxVarintLen32)) * 1.05)
+	neededSize := int(float64(b.N*(valueSize+binary.MaxVarintLen32+valuesDiskChecksumSize)) * 1.05)
 	if neededSize > size {
 		size = neededSize
 	}
-	v, err := newValuesDisk(path, uint32(size), 0)
+	v, err := newValuesDisk(path, int64(size), 0)
 	if err != nil {
 		b.Fatalf("couldn't create the DB: %s", err)
 	}
@@ -172,7 +354,7 @@ func BenchmarkValuesDiskGet(b *testing.B) {
 
 	value := make([]byte, 8)
 	binary.LittleEndian.PutUint64(value, uint64(257))
-	offset := uint32(0)
+	offset := uint64(0)
 	for i := 0; i < 100; i++ {
 		offset, _ = v.Set(value)
 	}
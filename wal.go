@@ -0,0 +1,192 @@
+package kvimd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	walFile = "wal.log"
+	// walCheckpointSize is the size after which the log is checkpointed (and emptied) in the background
+	walCheckpointSize = 64 << 20 // 64Mb
+)
+
+// writeAheadLog is an append-only file where writes are logged (and fsynced) before they are applied
+// to the mmapped files. On open, the log is replayed so that no write is lost if we crashed before the
+// OS wrote the mmapped pages back to disk. Once all the files are flushed, the log can be emptied (checkpoint)
+// A record is encoded as: crc32c (of the rest of the record) + value length as uvarint + key + value
+// It is thread-safe
+type writeAheadLog struct {
+	sync.Mutex
+	keySize int
+	file    *os.File
+	size    int64
+}
+
+func newWriteAheadLog(path string, keySize int) (*writeAheadLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to get file infos")
+	}
+	return &writeAheadLog{
+		keySize: keySize,
+		file:    f,
+		size:    info.Size(),
+	}, nil
+}
+
+// Append logs a write and only returns once it is persisted to disk
+func (w *writeAheadLog) Append(key, value []byte) error {
+	return w.AppendBatch([][]byte{key}, [][]byte{value})
+}
+
+// AppendBatch logs multiple writes with a single sync to disk
+func (w *writeAheadLog) AppendBatch(keys, values [][]byte) error {
+	size := 0
+	for i := range keys {
+		size += 4 + binary.MaxVarintLen64 + len(keys[i]) + len(values[i])
+	}
+	records := make([]byte, size)
+	n := 0
+	for i := range keys {
+		start := n
+		n += 4
+		n += binary.PutUvarint(records[n:], uint64(len(values[i])))
+		n += copy(records[n:], keys[i])
+		n += copy(records[n:], values[i])
+		encoding.PutUint32(records[start:start+4], crc32.Checksum(records[start+4:n], crcTable))
+	}
+	records = records[:n]
+
+	w.Lock()
+	defer w.Unlock()
+	if _, err := w.file.WriteAt(records, w.size); err != nil {
+		return errors.Wrap(err, "failed to write to log")
+	}
+	if err := w.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync log")
+	}
+	w.size += int64(len(records))
+	return nil
+}
+
+// AppendFrom logs a write of a value of size bytes read from r and only returns once it is persisted to disk
+func (w *writeAheadLog) AppendFrom(key []byte, r io.Reader, size int) error {
+	header := make([]byte, 4+binary.MaxVarintLen64+len(key))
+	n := 4 + binary.PutUvarint(header[4:], uint64(size))
+	n += copy(header[n:], key)
+	header = header[:n]
+	checksum := crc32.New(crcTable)
+	checksum.Write(header[4:])
+
+	w.Lock()
+	defer w.Unlock()
+	offset := w.size
+	if _, err := w.file.WriteAt(header, offset); err != nil {
+		return errors.Wrap(err, "failed to write to log")
+	}
+	offset += int64(len(header))
+	buf := make([]byte, 32<<10)
+	for remaining := size; remaining > 0; {
+		chunk := buf
+		if remaining < len(chunk) {
+			chunk = chunk[:remaining]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return errors.Wrap(err, "failed to read value")
+		}
+		checksum.Write(chunk)
+		if _, err := w.file.WriteAt(chunk, offset); err != nil {
+			return errors.Wrap(err, "failed to write to log")
+		}
+		offset += int64(len(chunk))
+		remaining -= len(chunk)
+	}
+	encoding.PutUint32(header[0:4], checksum.Sum32())
+	if _, err := w.file.WriteAt(header[0:4], w.size); err != nil {
+		return errors.Wrap(err, "failed to write to log")
+	}
+	if err := w.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync log")
+	}
+	w.size = offset
+	return nil
+}
+
+// Replay calls fn on every write of the log, in order.
+// The log stops at the first invalid record (a write that was torn by a crash), it is removed from the file
+func (w *writeAheadLog) Replay(fn func(key, value []byte) error) error {
+	w.Lock()
+	defer w.Unlock()
+	r := bufio.NewReader(io.NewSectionReader(w.file, 0, w.size))
+	var valid int64 // Size of the log up to the last valid record
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		valueSize, err := binary.ReadUvarint(r)
+		if err != nil || valueSize > uint64(w.size) {
+			break
+		}
+		length := make([]byte, binary.MaxVarintLen64)
+		length = length[:binary.PutUvarint(length, valueSize)]
+		data := make([]byte, w.keySize+int(valueSize))
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+		checksum := crc32.Update(crc32.Checksum(length, crcTable), crcTable, data)
+		if checksum != encoding.Uint32(header) {
+			break
+		}
+		if err := fn(data[:w.keySize], data[w.keySize:]); err != nil {
+			return err
+		}
+		valid += int64(len(header) + len(length) + len(data))
+	}
+	if valid < w.size {
+		return w.truncate(valid)
+	}
+	return nil
+}
+
+// Size returns the size of the log in bytes
+func (w *writeAheadLog) Size() int64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.size
+}
+
+// Truncate empties the log. It must only be called once all the logged writes are persisted in the database files
+func (w *writeAheadLog) Truncate() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.truncate(0)
+}
+
+func (w *writeAheadLog) truncate(size int64) error {
+	if err := w.file.Truncate(size); err != nil {
+		return errors.Wrap(err, "failed to truncate log")
+	}
+	if err := w.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync log")
+	}
+	w.size = size
+	return nil
+}
+
+// Close the log. It is not safe to call any other method after it
+func (w *writeAheadLog) Close() error {
+	return w.file.Close()
+}
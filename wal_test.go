@@ -0,0 +1,92 @@
+package kvimd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, walFile)
+
+	w, err := newWriteAheadLog(path, defaultKeySize)
+	require.NoError(t, err)
+	tests := make([]kvimdTestCase, 100)
+	for i := range tests {
+		tests[i] = generateKvimdTest()
+		if i%2 == 0 {
+			err = w.Append(tests[i].Key, tests[i].Value)
+		} else {
+			err = w.AppendFrom(tests[i].Key, bytes.NewReader(tests[i].Value), len(tests[i].Value))
+		}
+		require.NoError(t, err)
+	}
+	err = w.Close()
+	require.NoError(t, err)
+
+	// Reopen, we get back all the writes in order
+	w, err = newWriteAheadLog(path, defaultKeySize)
+	require.NoError(t, err)
+	defer w.Close()
+	var replayed []kvimdTestCase
+	err = w.Replay(func(key, value []byte) error {
+		replayed = append(replayed, kvimdTestCase{
+			Key:   append([]byte(nil), key...),
+			Value: append([]byte{}, value...),
+		})
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, tests, replayed)
+
+	// Once truncated, there is nothing left to replay
+	err = w.Truncate()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), w.Size())
+	err = w.Replay(func(key, value []byte) error {
+		t.Fatal("log should be empty")
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestWriteAheadLogTornWrite(t *testing.T) {
+	// Check that a record that was partially written when we crashed is dropped
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, walFile)
+
+	w, err := newWriteAheadLog(path, defaultKeySize)
+	require.NoError(t, err)
+	first := generateKvimdTest()
+	err = w.Append(first.Key, first.Value)
+	require.NoError(t, err)
+	validSize := w.Size()
+	err = w.Append(generateKvimdTest().Key, []byte("torn"))
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	err = os.Truncate(path, w.size-2)
+	require.NoError(t, err)
+
+	w, err = newWriteAheadLog(path, defaultKeySize)
+	require.NoError(t, err)
+	defer w.Close()
+	replayed := 0
+	err = w.Replay(func(key, value []byte) error {
+		require.Equal(t, first.Key, key)
+		replayed++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, replayed)
+	require.Equal(t, validSize, w.Size())
+}